@@ -0,0 +1,180 @@
+package pse
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// CounterPath is a performance counter path, in the syntax used by perfmon,
+// PDH and typeperf:
+//
+//	\\Machine\Object(Parent/Instance#Index)\Counter
+//
+// The machine, parent, instance and index are optional.  Instances and
+// counters may hold * wildcards, which are kept as is.
+type CounterPath struct {
+	Machine  string // machine name, without the leading \\
+	Object   string // performance object, eg: "Process"
+	Parent   string // parent instance, eg: the process of a thread
+	Instance string // instance name, without its index
+	Index    int    // index of instances sharing a name, 0 for the first
+	HasIndex bool   // whether the index is written, as in <name>#0
+	Counter  string // counter name, eg: "% Processor Time"
+}
+
+// ParseCounterPath parses a counter path.  The first instance of a name
+// can be written both <name> and <name>#0: both have index 0, HasIndex
+// telling them apart.  Only a decimal number without leading zeros is an
+// index, others are part of the instance name.
+func ParseCounterPath(s string) (CounterPath, error) {
+	var p CounterPath
+	path := s
+	if strings.HasPrefix(path, `\\`) {
+		i := strings.IndexByte(path[2:], '\\')
+		if i < 0 {
+			return CounterPath{}, fmt.Errorf("pse: invalid counter path %q", s)
+		}
+		p.Machine, path = path[2:2+i], path[2+i:]
+	}
+	if !strings.HasPrefix(path, `\`) {
+		return CounterPath{}, fmt.Errorf("pse: invalid counter path %q", s)
+	}
+	path = path[1:]
+
+	// the object ends at its instance, or at the counter.  Instance names
+	// may hold parentheses, so the instance ends at the last )\.
+	i := strings.IndexAny(path, `(\`)
+	if i <= 0 {
+		return CounterPath{}, fmt.Errorf("pse: invalid counter path %q", s)
+	}
+	p.Object = path[:i]
+	if path[i] == '(' {
+		j := strings.LastIndex(path, `)\`)
+		if j < i {
+			return CounterPath{}, fmt.Errorf("pse: invalid counter path %q", s)
+		}
+		inst := path[i+1 : j]
+		path = path[j+1:]
+
+		if k := strings.IndexByte(inst, '/'); k >= 0 {
+			p.Parent, inst = inst[:k], inst[k+1:]
+			if p.Parent == "" {
+				return CounterPath{}, fmt.Errorf("pse: invalid counter path %q", s)
+			}
+		}
+		if inst == "" {
+			return CounterPath{}, fmt.Errorf("pse: invalid counter path %q", s)
+		}
+		p.Instance, p.Index, p.HasIndex = splitInstanceIndex(inst)
+	} else {
+		path = path[i:]
+	}
+	p.Counter = path[1:]
+	if p.Counter == "" {
+		return CounterPath{}, fmt.Errorf("pse: invalid counter path %q", s)
+	}
+	return p, nil
+}
+
+// InstanceName returns the instance name with its index, as perfmon names
+// the instances sharing a name: <name>, <name>#1, <name>#2...  Index 0 is
+// written only if HasIndex is set.
+func (p CounterPath) InstanceName() string {
+	if p.Index > 0 || p.HasIndex {
+		return fmt.Sprintf("%s#%d", p.Instance, p.Index)
+	}
+	return p.Instance
+}
+
+// String returns the path in perfmon syntax.
+func (p CounterPath) String() string {
+	var b strings.Builder
+	if p.Machine != "" {
+		b.WriteString(`\\`)
+		b.WriteString(p.Machine)
+	}
+	b.WriteByte('\\')
+	b.WriteString(p.Object)
+	if p.Instance != "" || p.Parent != "" {
+		b.WriteByte('(')
+		if p.Parent != "" {
+			b.WriteString(p.Parent)
+			b.WriteByte('/')
+		}
+		b.WriteString(p.InstanceName())
+		b.WriteByte(')')
+	}
+	b.WriteByte('\\')
+	b.WriteString(p.Counter)
+	return b.String()
+}
+
+// processCounterPath returns the path of a counter of the Process object
+// for an instance name, which may hold an index or a wildcard.
+func processCounterPath(instName, counter string) string {
+	p := CounterPath{Object: "Process", Counter: counter}
+	p.Instance, p.Index, p.HasIndex = splitInstanceIndex(instName)
+	return p.String()
+}
+
+// splitProcessV2Instance splits the name of a Process V2 instance,
+// <image>:<pid>, into its image name and pid.
+func splitProcessV2Instance(inst string) (string, int, bool) {
+	k := strings.LastIndexByte(inst, ':')
+	if k < 0 {
+		return "", 0, false
+	}
+	pid, err := strconv.Atoi(inst[k+1:])
+	if err != nil || pid < 0 {
+		return "", 0, false
+	}
+	return inst[:k], pid, true
+}
+
+// splitInstanceIndex splits an instance name into its name and index, and
+// reports whether it has one.
+func splitInstanceIndex(inst string) (string, int, bool) {
+	k := strings.LastIndexByte(inst, '#')
+	if k < 0 {
+		return inst, 0, false
+	}
+	index := inst[k+1:]
+	// the index must write back the same, #01 or #+1 are names
+	if index == "" || (index[0] == '0' && len(index) > 1) {
+		return inst, 0, false
+	}
+	for _, c := range index {
+		if c < '0' || c > '9' {
+			return inst, 0, false
+		}
+	}
+	n, err := strconv.Atoi(index)
+	if err != nil {
+		return inst, 0, false
+	}
+	return inst[:k], n, true
+}
+
+// processCounter is a counter of the Process object, and the usage metric
+// it sets.
+type processCounter struct {
+	name   string // English counter name
+	metric Metrics
+	set    func(u *Usage, v float64)
+}
+
+// processCounterSet are the counters of a process sampled by the counter
+// based backends, along with its ID Process.
+var processCounterSet = [...]processCounter{
+	{"% Processor Time", MetricCPU, func(u *Usage, v float64) { u.CPU = v }},
+	{"% User Time", MetricUserCPU, func(u *Usage, v float64) { u.UserCPU = v }},
+	{"% Privileged Time", MetricKernelCPU, func(u *Usage, v float64) { u.KernelCPU = v }},
+	{"Working Set", MetricWorkingSet, func(u *Usage, v float64) { u.Memory.WorkingSet = int64(v) }},
+	{"Working Set - Private", MetricPrivateWorkingSet, func(u *Usage, v float64) { u.Memory.PrivateWorkingSet = int64(v) }},
+	{"Private Bytes", MetricPrivateBytes, func(u *Usage, v float64) { u.Memory.PrivateBytes = int64(v) }},
+	{"Virtual Bytes", MetricVirtual, func(u *Usage, v float64) { u.Memory.Virtual = int64(v) }},
+	{"Working Set Peak", MetricPeakWorkingSet, func(u *Usage, v float64) { u.Memory.PeakWorkingSet = int64(v) }},
+	{"Page File Bytes Peak", MetricPeakPrivateBytes, func(u *Usage, v float64) { u.Memory.PeakPrivateBytes = int64(v) }},
+	{"Virtual Bytes Peak", MetricPeakVirtual, func(u *Usage, v float64) { u.Memory.PeakVirtual = int64(v) }},
+}
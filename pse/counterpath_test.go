@@ -0,0 +1,99 @@
+package pse
+
+import "testing"
+
+func TestSplitProcessV2Instance(t *testing.T) {
+	tests := []struct {
+		inst  string
+		image string
+		pid   int
+		ok    bool
+	}{
+		{"gnatsd:5123", "gnatsd", 5123, true},
+		{"my:app:42", "my:app", 42, true},
+		{"gnatsd", "", 0, false},
+		{"gnatsd#1", "", 0, false},
+		{"gnatsd:", "", 0, false},
+		{"gnatsd:-1", "", 0, false},
+	}
+	for _, tt := range tests {
+		image, pid, ok := splitProcessV2Instance(tt.inst)
+		if image != tt.image || pid != tt.pid || ok != tt.ok {
+			t.Errorf("splitProcessV2Instance(%q) = %q, %d, %v, want %q, %d, %v",
+				tt.inst, image, pid, ok, tt.image, tt.pid, tt.ok)
+		}
+	}
+}
+
+func TestCounterPathRoundTrip(t *testing.T) {
+	tests := []struct {
+		path string
+		p    CounterPath
+	}{
+		{`\Memory\Available Bytes`, CounterPath{Object: "Memory", Counter: "Available Bytes"}},
+		{`\\HOST\Process(gnatsd)\% Processor Time`, CounterPath{Machine: "HOST", Object: "Process", Instance: "gnatsd", Counter: "% Processor Time"}},
+		{`\\HOST\Process(gnatsd#2)\% Processor Time`, CounterPath{Machine: "HOST", Object: "Process", Instance: "gnatsd", Index: 2, HasIndex: true, Counter: "% Processor Time"}},
+		{`\Process(gnatsd#0)\ID Process`, CounterPath{Object: "Process", Instance: "gnatsd", HasIndex: true, Counter: "ID Process"}},
+		{`\Process(gnatsd#01)\ID Process`, CounterPath{Object: "Process", Instance: "gnatsd#01", Counter: "ID Process"}},
+		{`\Process(gnatsd#+1)\ID Process`, CounterPath{Object: "Process", Instance: "gnatsd#+1", Counter: "ID Process"}},
+		{`\Process(gnatsd#)\ID Process`, CounterPath{Object: "Process", Instance: "gnatsd#", Counter: "ID Process"}},
+		{`\Process(my#app#1)\ID Process`, CounterPath{Object: "Process", Instance: "my#app", Index: 1, HasIndex: true, Counter: "ID Process"}},
+		{`\Process(*)\ID Process`, CounterPath{Object: "Process", Instance: "*", Counter: "ID Process"}},
+		{`\Process(gnatsd*)\*`, CounterPath{Object: "Process", Instance: "gnatsd*", Counter: "*"}},
+		{`\Thread(gnatsd/3#1)\Context Switches/sec`, CounterPath{Object: "Thread", Parent: "gnatsd", Instance: "3", Index: 1, HasIndex: true, Counter: "Context Switches/sec"}},
+		{`\Processor Information(0,_Total)\% Processor Time`, CounterPath{Object: "Processor Information", Instance: "0,_Total", Counter: "% Processor Time"}},
+		{`\Process(svc (x))\ID Process`, CounterPath{Object: "Process", Instance: "svc (x)", Counter: "ID Process"}},
+		{`\Process V2(gnatsd:5123)\ID Process`, CounterPath{Object: "Process V2", Instance: "gnatsd:5123", Counter: "ID Process"}},
+		{`\Prozess(gnatsd)\Prozessorzeit (%)`, CounterPath{Object: "Prozess", Instance: "gnatsd", Counter: "Prozessorzeit (%)"}},
+	}
+	for _, tt := range tests {
+		p, err := ParseCounterPath(tt.path)
+		if err != nil {
+			t.Errorf("ParseCounterPath(%q): %v", tt.path, err)
+			continue
+		}
+		if p != tt.p {
+			t.Errorf("ParseCounterPath(%q) = %+v, want %+v", tt.path, p, tt.p)
+		}
+		if s := p.String(); s != tt.path {
+			t.Errorf("String() = %q, want %q", s, tt.path)
+		}
+	}
+}
+
+func TestCounterPathInvalid(t *testing.T) {
+	for _, s := range []string{
+		``,
+		`Process\ID Process`,
+		`\\HOST`,
+		`\\HOST\`,
+		`\Process(x\ID Process`,
+		`\Process\`,
+		`\\Process(x)`,
+		`\(x)\ID Process`,
+		`\Process()\ID Process`,
+		`\Thread(/3)\Context Switches/sec`,
+		`\Thread(gnatsd/)\Context Switches/sec`,
+	} {
+		if p, err := ParseCounterPath(s); err == nil {
+			t.Errorf("ParseCounterPath(%q) = %+v, want an error", s, p)
+		}
+	}
+}
+
+func TestCounterKey(t *testing.T) {
+	tests := []struct {
+		path string
+		key  string
+	}{
+		{`\\HOST\Process(gnatsd)\ID Process`, `\process(gnatsd)\id process`},
+		{`\Process(GNATSD#0)\ID Process`, `\process(gnatsd)\id process`},
+		{`\Process(gnatsd#1)\ID Process`, `\process(gnatsd#1)\id process`},
+		{`not a path`, `not a path`},
+	}
+	for _, tt := range tests {
+		if key := counterKey(tt.path); key != tt.key {
+			t.Errorf("counterKey(%q) = %q, want %q", tt.path, key, tt.key)
+		}
+	}
+}
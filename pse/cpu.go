@@ -0,0 +1,193 @@
+package pse
+
+import "time"
+
+// CPUMode selects what the CPU of a usage reports.
+type CPUMode int
+
+// CPU modes
+const (
+	// CPUPerCore is the percent cpu of a single cpu, as reported by top
+	// and ps: a process keeping two cpus busy uses 200%.
+	CPUPerCore CPUMode = iota
+
+	// CPUMachine is the percent cpu of the whole machine, from 0 to 100
+	// whatever the number of logical cpus.
+	CPUMachine
+
+	// CPUSecondsTotal is the cpu time used by the process since it
+	// started, in seconds, which only increases.  The typeperf and replay
+	// backends only read percentages, and do not support it.
+	CPUSecondsTotal
+)
+
+// cpuMetrics are the metrics reported in the cpu mode.
+const cpuMetrics = MetricCPU | MetricUserCPU | MetricKernelCPU
+
+// CPUTimes are the cpu times of a process, or of every cpu of the system.
+type CPUTimes struct {
+	User   time.Duration // time running in user mode
+	Kernel time.Duration // time running in kernel mode, idle time excluded
+	Idle   time.Duration // idle time, for the system only
+}
+
+// Busy returns the time spent running, in user or kernel mode.
+func (t CPUTimes) Busy() time.Duration {
+	return t.User + t.Kernel
+}
+
+// Total returns the busy and idle time.
+func (t CPUTimes) Total() time.Duration {
+	return t.User + t.Kernel + t.Idle
+}
+
+// CPUReading is a reading of the cpu times of a process, taken along with
+// those of the system.
+type CPUReading struct {
+	Time time.Time // wall clock time of the reading
+	Proc CPUTimes
+	Sys  CPUTimes
+
+	// Start is the creation time of the process, which tells apart the
+	// processes reusing a pid.  It is zero if unknown.
+	Start time.Time
+}
+
+// percentOf returns d as a percentage of base, or zero if base is not
+// positive.
+func percentOf(d, base time.Duration) float64 {
+	if base <= 0 {
+		return 0.0
+	}
+	return 100.0 * float64(d) / float64(base)
+}
+
+// CPUUsage is the cpu usage of a process, in a CPUMode, along with its
+// user and kernel mode parts.
+type CPUUsage struct {
+	Total  float64
+	User   float64
+	Kernel float64
+}
+
+// CPUAccount computes the cpu usage of processes from their successive
+// readings, according to its mode.  The system times and the clock are
+// read through the given functions, so that the accounting does not
+// depend on the platform.  It is not safe for concurrent use.
+type CPUAccount struct {
+	// Mode is what Update returns.
+	Mode CPUMode
+
+	// ReadSystem reads the cpu times of the system.
+	ReadSystem func() (CPUTimes, error)
+
+	// Now returns the wall clock time.  If nil, time.Now is used.
+	Now func() time.Time
+
+	// previous readings by pid
+	prev map[int]CPUReading
+}
+
+// SystemReading returns a reading of the system cpu times, to be completed
+// with the times of the processes sampled along with it.
+func (a *CPUAccount) SystemReading() (CPUReading, error) {
+	now := time.Now
+	if a.Now != nil {
+		now = a.Now
+	}
+	sys, err := a.ReadSystem()
+	if err != nil {
+		return CPUReading{}, err
+	}
+	return CPUReading{Time: now(), Sys: sys}, nil
+}
+
+// Update records the reading of a process and returns its cpu usage since
+// its previous reading, or its total cpu seconds in the CPUSecondsTotal
+// mode.  A percentage is not available on the first reading of a process,
+// which only establishes a baseline, nor when the previous reading was of
+// another process, whose pid was reused, nor when no time elapsed: false
+// is returned.  A reused pid is told by the start time of the process, or
+// when unknown by its cpu times going backwards.
+func (a *CPUAccount) Update(pid int, r CPUReading) (CPUUsage, bool) {
+	if a.prev == nil {
+		a.prev = make(map[int]CPUReading)
+	}
+	prev, ok := a.prev[pid]
+	a.prev[pid] = r
+	if a.Mode == CPUSecondsTotal {
+		return CPUUsage{
+			Total:  r.Proc.Busy().Seconds(),
+			User:   r.Proc.User.Seconds(),
+			Kernel: r.Proc.Kernel.Seconds(),
+		}, true
+	}
+	if !ok || !r.Start.Equal(prev.Start) || r.Proc.User < prev.Proc.User || r.Proc.Kernel < prev.Proc.Kernel {
+		return CPUUsage{}, false
+	}
+	base := r.Sys.Total() - prev.Sys.Total()
+	if a.Mode == CPUPerCore {
+		base = r.Time.Sub(prev.Time)
+	}
+	if base <= 0 {
+		return CPUUsage{}, false
+	}
+	user := r.Proc.User - prev.Proc.User
+	kernel := r.Proc.Kernel - prev.Proc.Kernel
+	return CPUUsage{
+		Total:  percentOf(user+kernel, base),
+		User:   percentOf(user, base),
+		Kernel: percentOf(kernel, base),
+	}, true
+}
+
+// Forget drops the previous reading of a process, once it is gone.
+func (a *CPUAccount) Forget(pid int) {
+	delete(a.prev, pid)
+}
+
+// Retain forgets the processes for which keep returns false.
+func (a *CPUAccount) Retain(keep func(pid int) bool) {
+	for pid := range a.prev {
+		if !keep(pid) {
+			delete(a.prev, pid)
+		}
+	}
+}
+
+// counterCPU converts the per core percent cpu of the % Processor Time,
+// % User Time and % Privileged Time counters to the cpu mode of the
+// options.  Their formatted values only measure the last interval, and
+// cannot give the total cpu seconds: backends reading them either read the
+// raw counter values in the CPUSecondsTotal mode, as pdh does, or do not
+// support it.
+type counterCPU struct {
+	mode CPUMode
+	cpus int
+}
+
+func newCounterCPU(opts *Options) *counterCPU {
+	cpus := opts.LogicalCPUs
+	if cpus <= 0 {
+		cpus = logicalCPUs()
+	}
+	return &counterCPU{mode: opts.CPUMode, cpus: cpus}
+}
+
+// convert converts the cpu of a usage in place.
+func (c *counterCPU) convert(u *Usage) {
+	if u.Valid&cpuMetrics == 0 || c.mode != CPUMachine {
+		return
+	}
+	u.CPU /= float64(c.cpus)
+	u.UserCPU /= float64(c.cpus)
+	u.KernelCPU /= float64(c.cpus)
+}
+
+// convertAll converts the cpu of the usages of a snapshot in place.
+func (c *counterCPU) convertAll(usages map[int]Usage) {
+	for pid, u := range usages {
+		c.convert(&u)
+		usages[pid] = u
+	}
+}
@@ -0,0 +1,163 @@
+package pse
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// cpuClock feeds a CPUAccount with the system times and wall clock time
+// set by a test.
+type cpuClock struct {
+	now time.Time
+	sys CPUTimes
+	err error
+}
+
+func (c *cpuClock) account(mode CPUMode) *CPUAccount {
+	return &CPUAccount{
+		Mode:       mode,
+		ReadSystem: func() (CPUTimes, error) { return c.sys, c.err },
+		Now:        func() time.Time { return c.now },
+	}
+}
+
+// advance moves the clock by d, the system running 4 cpus of which the
+// given share of the time is busy, half in user mode.
+func (c *cpuClock) advance(d time.Duration, busy float64) {
+	total := 4 * d
+	run := time.Duration(float64(total) * busy)
+	c.now = c.now.Add(d)
+	c.sys.User += run / 2
+	c.sys.Kernel += run - run/2
+	c.sys.Idle += total - run
+}
+
+// reading returns a reading of a process with the given cpu times.
+func (c *cpuClock) reading(t *testing.T, a *CPUAccount, user, kernel time.Duration) CPUReading {
+	r, err := a.SystemReading()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Proc = CPUTimes{User: user, Kernel: kernel}
+	return r
+}
+
+func TestCPUAccountModes(t *testing.T) {
+	// over 2s of 4 cpus, the process uses 1.5s of user and 0.5s of
+	// kernel time: one cpu.
+	tests := []struct {
+		mode  CPUMode
+		first bool     // whether the first reading has a usage
+		want  CPUUsage // of the second reading
+	}{
+		{CPUPerCore, false, CPUUsage{Total: 100, User: 75, Kernel: 25}},
+		{CPUMachine, false, CPUUsage{Total: 25, User: 18.75, Kernel: 6.25}},
+		{CPUSecondsTotal, true, CPUUsage{Total: 7, User: 4.5, Kernel: 2.5}},
+	}
+	for _, tt := range tests {
+		c := &cpuClock{now: time.Unix(1460907480, 0)}
+		a := c.account(tt.mode)
+		r := c.reading(t, a, 3*time.Second, 2*time.Second)
+		if r.Time != c.now || r.Sys != c.sys {
+			t.Fatalf("mode %d: reading %+v", tt.mode, r)
+		}
+		if _, ok := a.Update(1, r); ok != tt.first {
+			t.Errorf("mode %d: first reading ok = %v", tt.mode, ok)
+		}
+
+		c.advance(2*time.Second, 0.5)
+		got, ok := a.Update(1, c.reading(t, a, 4500*time.Millisecond, 2500*time.Millisecond))
+		if !ok || got != tt.want {
+			t.Errorf("mode %d: got %+v, %v, want %+v", tt.mode, got, ok, tt.want)
+		}
+	}
+}
+
+func TestCPUAccountBaseline(t *testing.T) {
+	start := time.Unix(1460907000, 0)
+	tests := []struct {
+		name    string
+		elapsed time.Duration // between the readings
+		start   time.Time     // of the second reading
+		user    time.Duration // of the second reading, the first one 2s
+		ok      bool
+	}{
+		{"same process", time.Second, start, 3 * time.Second, true},
+		{"no cpu", time.Second, start, 2 * time.Second, true},
+		{"backwards", time.Second, start, time.Second, false},
+		{"reused pid", time.Second, start.Add(time.Minute), 5 * time.Second, false},
+		{"zero elapsed", 0, start, 3 * time.Second, false},
+	}
+	for _, mode := range []CPUMode{CPUPerCore, CPUMachine} {
+		for _, tt := range tests {
+			c := &cpuClock{now: time.Unix(1460907480, 0)}
+			a := c.account(mode)
+			r := c.reading(t, a, 2*time.Second, 0)
+			r.Start = start
+			a.Update(1, r)
+
+			if tt.elapsed > 0 {
+				c.advance(tt.elapsed, 0.5)
+			}
+			r = c.reading(t, a, tt.user, 0)
+			r.Start = tt.start
+			if _, ok := a.Update(1, r); ok != tt.ok {
+				t.Errorf("mode %d: %s: ok = %v, want %v", mode, tt.name, ok, tt.ok)
+			}
+
+			// the reading is the new baseline
+			c.advance(time.Second, 0.5)
+			r = c.reading(t, a, tt.user+time.Second, 0)
+			r.Start = tt.start
+			if _, ok := a.Update(1, r); !ok {
+				t.Errorf("mode %d: %s: no usage after a new baseline", mode, tt.name)
+			}
+		}
+	}
+}
+
+func TestCPUAccountForget(t *testing.T) {
+	c := &cpuClock{now: time.Unix(1460907480, 0)}
+	a := c.account(CPUPerCore)
+	for pid := 1; pid <= 3; pid++ {
+		a.Update(pid, c.reading(t, a, 0, 0))
+	}
+	c.advance(time.Second, 0.5)
+
+	a.Forget(1)
+	a.Retain(func(pid int) bool { return pid != 3 })
+	for pid, want := range map[int]bool{1: false, 2: true, 3: false} {
+		if _, ok := a.Update(pid, c.reading(t, a, 0, 0)); ok != want {
+			t.Errorf("pid %d: ok = %v, want %v", pid, ok, want)
+		}
+	}
+	a.Forget(42)
+}
+
+func TestCPUAccountSystemError(t *testing.T) {
+	c := &cpuClock{err: errors.New("no system times")}
+	if _, err := c.account(CPUMachine).SystemReading(); err != c.err {
+		t.Fatalf("got %v, want %v", err, c.err)
+	}
+}
+
+func TestCounterCPU(t *testing.T) {
+	u := Usage{CPU: 200, UserCPU: 150, KernelCPU: 50, RSS: 4096, Valid: cpuMetrics | MetricRSS}
+	tests := []struct {
+		mode CPUMode
+		want Usage
+	}{
+		{CPUPerCore, u},
+		{CPUMachine, Usage{CPU: 50, UserCPU: 37.5, KernelCPU: 12.5, RSS: 4096, Valid: u.Valid}},
+		{CPUSecondsTotal, u},
+	}
+	for _, tt := range tests {
+		got := map[int]Usage{1: u}
+		newCounterCPU(&Options{CPUMode: tt.mode, LogicalCPUs: 4}).convertAll(got)
+		if !reflect.DeepEqual(got[1], tt.want) {
+			t.Errorf("mode %d: got %+v, want %+v", tt.mode, got[1], tt.want)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package pse
+
+// Memory holds the memory metrics of a process, in bytes.  Metrics that the
+// backend does not report are zero, and missing from the Valid metrics of
+// the usage.
+type Memory struct {
+	// WorkingSet is the resident memory, the rss of ps.
+	WorkingSet int64
+
+	// PrivateWorkingSet is the resident memory not shared with other
+	// processes.
+	PrivateWorkingSet int64
+
+	// PrivateBytes is the private memory committed by the process, resident
+	// or not: the commit charge of the process.
+	PrivateBytes int64
+
+	// Virtual is the size of the address space, the vsz of ps.
+	Virtual int64
+
+	// Peak values of the above, since the process started.
+	PeakWorkingSet   int64
+	PeakPrivateBytes int64
+	PeakVirtual      int64
+}
+
+// Memory metrics, set in the Valid metrics of a usage along with the
+// Memory field they stand for.  One of them maps to the RSS and VSS of
+// the usage, as selected by the options.
+const (
+	MetricWorkingSet Metrics = MetricMemPercent << (1 + iota)
+	MetricPrivateWorkingSet
+	MetricPrivateBytes
+	MetricVirtual
+	MetricPeakWorkingSet
+	MetricPeakPrivateBytes
+	MetricPeakVirtual
+)
+
+// Get returns the value of a memory metric.
+func (m *Memory) Get(metric Metrics) int64 {
+	switch metric {
+	case MetricWorkingSet:
+		return m.WorkingSet
+	case MetricPrivateWorkingSet:
+		return m.PrivateWorkingSet
+	case MetricPrivateBytes:
+		return m.PrivateBytes
+	case MetricVirtual:
+		return m.Virtual
+	case MetricPeakWorkingSet:
+		return m.PeakWorkingSet
+	case MetricPeakPrivateBytes:
+		return m.PeakPrivateBytes
+	case MetricPeakVirtual:
+		return m.PeakVirtual
+	}
+	return 0
+}
+
+// mapMemory sets the RSS and VSS of a usage from the memory metrics
+// selected by the options.  They are missing if the backend did not report
+// the selected metric.
+func (o *Options) mapMemory(u *Usage) {
+	rss, vss := o.RSSMetric, o.VSSMetric
+	if rss == 0 {
+		rss = MetricWorkingSet
+	}
+	if vss == 0 {
+		vss = MetricVirtual
+	}
+	u.RSS, u.VSS = 0, 0
+	u.Valid &^= MetricRSS | MetricVSS
+	if u.Valid.Has(rss) {
+		u.RSS = u.Memory.Get(rss)
+		u.Valid |= MetricRSS
+	}
+	if u.Valid.Has(vss) {
+		u.VSS = u.Memory.Get(vss)
+		u.Valid |= MetricVSS
+	}
+}
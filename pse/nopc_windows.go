@@ -0,0 +1,287 @@
+package pse
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+var (
+	modkernel32        = syscall.NewLazyDLL("kernel32.dll")
+	procGetSystemTimes = modkernel32.NewProc("GetSystemTimes")
+
+	procQueryFullProcessImageName = modkernel32.NewProc("QueryFullProcessImageNameW")
+
+	modpsapi                 = syscall.NewLazyDLL("psapi.dll")
+	procGetProcessMemoryInfo = modpsapi.NewProc("GetProcessMemoryInfo")
+
+	modntdll                      = syscall.NewLazyDLL("ntdll.dll")
+	procNtQueryInformationProcess = modntdll.NewProc("NtQueryInformationProcess")
+)
+
+// processMemoryCountersEx is the PROCESS_MEMORY_COUNTERS_EX structure of
+// GetProcessMemoryInfo.
+type processMemoryCountersEx struct {
+	CB                         uint32
+	PageFaultCount             uint32
+	PeakWorkingSetSize         uintptr
+	WorkingSetSize             uintptr
+	QuotaPeakPagedPoolUsage    uintptr
+	QuotaPagedPoolUsage        uintptr
+	QuotaPeakNonPagedPoolUsage uintptr
+	QuotaNonPagedPoolUsage     uintptr
+	PagefileUsage              uintptr
+	PeakPagefileUsage          uintptr
+	PrivateUsage               uintptr
+}
+
+func getProcessMemoryInfo(h syscall.Handle, mem *processMemoryCountersEx) (err error) {
+	r1, _, e1 := syscall.Syscall(procGetProcessMemoryInfo.Addr(), 3, uintptr(h), uintptr(unsafe.Pointer(mem)), uintptr(unsafe.Sizeof(*mem)))
+	if r1 == 0 {
+		if e1 != 0 {
+			err = error(e1)
+		} else {
+			err = syscall.EINVAL
+		}
+	}
+	return
+}
+
+// vmCounters is the VM_COUNTERS structure of the ProcessVmCounters
+// information class of NtQueryInformationProcess, which unlike
+// PROCESS_MEMORY_COUNTERS holds the virtual sizes.
+type vmCounters struct {
+	PeakVirtualSize            uintptr
+	VirtualSize                uintptr
+	PageFaultCount             uint32
+	PeakWorkingSetSize         uintptr
+	WorkingSetSize             uintptr
+	QuotaPeakPagedPoolUsage    uintptr
+	QuotaPagedPoolUsage        uintptr
+	QuotaPeakNonPagedPoolUsage uintptr
+	QuotaNonPagedPoolUsage     uintptr
+	PagefileUsage              uintptr
+	PeakPagefileUsage          uintptr
+}
+
+const processVmCounters = 3
+
+func getProcessVMCounters(h syscall.Handle, vm *vmCounters) error {
+	if err := procNtQueryInformationProcess.Find(); err != nil {
+		return err
+	}
+	r1, _, _ := syscall.Syscall6(procNtQueryInformationProcess.Addr(), 5, uintptr(h), processVmCounters, uintptr(unsafe.Pointer(vm)), unsafe.Sizeof(*vm), 0, 0)
+	if r1 != 0 {
+		return fmt.Errorf("NtQueryInformationProcess failed with status 0x%X", uint32(r1))
+	}
+	return nil
+}
+
+// getProcessImageName returns the base name of the process image, without
+// the extension.
+func getProcessImageName(h syscall.Handle) (string, error) {
+	buf := make([]uint16, syscall.MAX_LONG_PATH)
+	size := uint32(len(buf))
+	r1, _, e1 := procQueryFullProcessImageName.Call(uintptr(h), 0, uintptr(unsafe.Pointer(&buf[0])), uintptr(unsafe.Pointer(&size)))
+	if r1 == 0 {
+		if e1 != nil {
+			return "", e1
+		}
+		return "", syscall.EINVAL
+	}
+	name := filepath.Base(syscall.UTF16ToString(buf[:size]))
+	return strings.TrimSuffix(name, filepath.Ext(name)), nil
+}
+
+func getSystemTimes(idleTime, kernelTime, userTime *syscall.Filetime) (err error) {
+	r1, _, e1 := procGetSystemTimes.Call(uintptr(unsafe.Pointer(idleTime)), uintptr(unsafe.Pointer(kernelTime)), uintptr(unsafe.Pointer(userTime)))
+	if r1 == 0 {
+		if e1 != nil {
+			err = error(e1)
+		} else {
+			err = syscall.EINVAL
+		}
+	}
+	return
+}
+
+func fileTimeToInt64(ft *syscall.Filetime) int64 {
+	return int64(ft.HighDateTime)<<32 + int64(ft.LowDateTime)
+}
+
+// filetimeDuration converts a FILETIME interval, in 100ns units.
+func filetimeDuration(ft *syscall.Filetime) time.Duration {
+	return time.Duration(fileTimeToInt64(ft)) * 100
+}
+
+// readProcessCPUTimes returns the cpu times of a process, and its creation
+// time.
+func readProcessCPUTimes(h syscall.Handle) (CPUTimes, time.Time, error) {
+	var pCreate, pExit, pKernel, pUser syscall.Filetime
+
+	if err := syscall.GetProcessTimes(h, &pCreate, &pExit, &pKernel, &pUser); err != nil {
+		return CPUTimes{}, time.Time{}, err
+	}
+	return CPUTimes{
+		User:   filetimeDuration(&pUser),
+		Kernel: filetimeDuration(&pKernel),
+	}, time.Unix(0, pCreate.Nanoseconds()), nil
+}
+
+// readSystemCPUTimes returns the cpu times of the system.  The kernel time
+// of GetSystemTimes includes the idle time.
+func readSystemCPUTimes() (CPUTimes, error) {
+	var sIdle, sKernel, sUser syscall.Filetime
+
+	if err := getSystemTimes(&sIdle, &sKernel, &sUser); err != nil {
+		return CPUTimes{}, err
+	}
+	return CPUTimes{
+		User:   filetimeDuration(&sUser),
+		Kernel: filetimeDuration(&sKernel) - filetimeDuration(&sIdle),
+		Idle:   filetimeDuration(&sIdle),
+	}, nil
+}
+
+func init() {
+	Register("nopc", openNopcBackend)
+}
+
+// Win32 constants not defined by the syscall package.
+const (
+	processVMRead                       = 0x0010
+	errorInvalidParameter syscall.Errno = 87
+)
+
+// nopcBackend retrieves process usage through GetProcessTimes and
+// GetProcessMemoryInfo, for systems where performance counters are
+// unavailable or disabled.
+type nopcBackend struct {
+	opts *Options
+	cpu  *CPUAccount
+}
+
+func openNopcBackend(opts *Options) (Backend, error) {
+	return &nopcBackend{
+		opts: opts,
+		cpu:  &CPUAccount{Mode: opts.CPUMode, ReadSystem: readSystemCPUTimes},
+	}, nil
+}
+
+// SnapshotAll implements Backend.  Processes are enumerated with a tool
+// help snapshot, then sampled one at a time.  Processes that exit or
+// cannot be opened in the meantime are left out.
+func (b *nopcBackend) SnapshotAll() (map[int]Usage, error) {
+	snap, err := syscall.CreateToolhelp32Snapshot(syscall.TH32CS_SNAPPROCESS, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer syscall.CloseHandle(snap)
+
+	var pids []int
+	var pe syscall.ProcessEntry32
+	pe.Size = uint32(unsafe.Sizeof(pe))
+	for err = syscall.Process32First(snap, &pe); err == nil; err = syscall.Process32Next(snap, &pe) {
+		name := syscall.UTF16ToString(pe.ExeFile[:])
+		name = strings.TrimSuffix(name, filepath.Ext(name))
+		if b.opts.matchImage(name) {
+			pids = append(pids, int(pe.ProcessID))
+		}
+	}
+	if err != syscall.ERROR_NO_MORE_FILES {
+		return nil, err
+	}
+
+	usages := make(map[int]Usage, len(pids))
+	for _, pid := range pids {
+		u, err := b.UsageForPID(pid)
+		if err == ErrNotFound || err == syscall.ERROR_ACCESS_DENIED {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		usages[pid] = u
+	}
+
+	// forget the processes that are gone
+	b.cpu.Retain(func(pid int) bool {
+		_, ok := usages[pid]
+		return ok
+	})
+	return usages, nil
+}
+
+// UsageForPID implements Backend, opening a handle to the process.  The
+// process is not found if its image does not match the options.
+func (b *nopcBackend) UsageForPID(pid int) (Usage, error) {
+	var mem processMemoryCountersEx
+
+	h, err := syscall.OpenProcess(syscall.PROCESS_QUERY_INFORMATION|processVMRead, false, uint32(pid))
+	if err != nil {
+		b.cpu.Forget(pid)
+		if err == errorInvalidParameter {
+			// there is no process with this pid
+			return Usage{}, ErrNotFound
+		}
+		return Usage{}, err
+	}
+	defer syscall.CloseHandle(h)
+
+	image, err := getProcessImageName(h)
+	if err != nil {
+		return Usage{}, err
+	}
+	if !b.opts.matchImage(image) {
+		b.cpu.Forget(pid)
+		return Usage{}, ErrNotFound
+	}
+
+	if err = getProcessMemoryInfo(h, &mem); err != nil {
+		return Usage{}, err
+	}
+
+	r, err := b.cpu.SystemReading()
+	if err != nil {
+		return Usage{}, err
+	}
+	if r.Proc, r.Start, err = readProcessCPUTimes(h); err != nil {
+		return Usage{}, err
+	}
+
+	u := Usage{
+		PID: pid,
+		Memory: Memory{
+			WorkingSet:       int64(mem.WorkingSetSize),
+			PrivateBytes:     int64(mem.PrivateUsage),
+			PeakWorkingSet:   int64(mem.PeakWorkingSetSize),
+			PeakPrivateBytes: int64(mem.PeakPagefileUsage),
+		},
+		Valid:     MetricWorkingSet | MetricPrivateBytes | MetricPeakWorkingSet | MetricPeakPrivateBytes,
+		Time:      r.Time,
+		Collected: r.Time,
+	}
+	// the virtual sizes are only available from the native API
+	var vm vmCounters
+	if getProcessVMCounters(h, &vm) == nil {
+		u.Memory.Virtual = int64(vm.VirtualSize)
+		u.Memory.PeakVirtual = int64(vm.PeakVirtualSize)
+		u.Valid |= MetricVirtual | MetricPeakVirtual
+	}
+	// the first sample of a process only establishes a baseline
+	if cpu, ok := b.cpu.Update(pid, r); ok {
+		u.CPU = cpu.Total
+		u.UserCPU = cpu.User
+		u.KernelCPU = cpu.Kernel
+		u.Valid |= MetricCPU | MetricUserCPU | MetricKernelCPU
+	}
+	return u, nil
+}
+
+// Close implements Backend.
+func (b *nopcBackend) Close() error {
+	return nil
+}
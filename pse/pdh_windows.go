@@ -0,0 +1,512 @@
+package pse
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+var (
+	pdh                            = syscall.NewLazyDLL("pdh.dll")
+	winPdhOpenQuery                = pdh.NewProc("PdhOpenQuery")
+	winPdhCloseQuery               = pdh.NewProc("PdhCloseQuery")
+	winPdhAddCounter               = pdh.NewProc("PdhAddCounterW")
+	winPdhAddEnglishCounter        = pdh.NewProc("PdhAddEnglishCounterW")
+	winPdhCollectQueryData         = pdh.NewProc("PdhCollectQueryData")
+	winPdhGetFormattedCounterArray = pdh.NewProc("PdhGetFormattedCounterArrayW")
+	winPdhGetRawCounterArray       = pdh.NewProc("PdhGetRawCounterArrayW")
+)
+
+// maximum attempts at reading a counter array, should instances keep
+// appearing between the sizing and the reading calls.
+const maxArrayAttempts = 10
+
+// PDH Types
+type (
+	pdhHQuery   syscall.Handle // query handle
+	pdhHCounter syscall.Handle // counter handle
+)
+
+// PDH constants used here, status codes are in pdherrors.go
+const (
+	pdhFmtDouble   = 0x00000200
+	pdhFmtNoCap100 = 0x00008000
+)
+
+// pdhFmtCounterValueDouble - double value
+type pdhFmtCounterValueDouble struct {
+	CStatus     uint32
+	DoubleValue float64
+}
+
+// pdhFmtCounterValueItemDouble is an array
+// element of a double value
+type pdhFmtCounterValueItemDouble struct {
+	SzName   *uint16 // pointer to a string
+	FmtValue pdhFmtCounterValueDouble
+}
+
+// pdhRawCounter is the raw value of a counter.  For the 100ns timers
+// such as % Processor Time, FirstValue is the time counted.
+type pdhRawCounter struct {
+	CStatus     uint32
+	TimeStamp   syscall.Filetime
+	FirstValue  int64
+	SecondValue int64
+	MultiCount  uint32
+}
+
+// pdhRawCounterItem is an array element of a raw value
+type pdhRawCounterItem struct {
+	SzName   *uint16 // pointer to a string
+	RawValue pdhRawCounter
+}
+
+func pdhAddCounter(hQuery pdhHQuery, szFullCounterPath string, dwUserData uintptr, phCounter *pdhHCounter) error {
+	return pdhAddCounterProc(winPdhAddCounter, "PdhAddCounter", hQuery, szFullCounterPath, dwUserData, phCounter)
+}
+
+// pdhAddEnglishCounter adds a counter by its English path, whatever the
+// language of the system.  It is available from Windows Vista.
+func pdhAddEnglishCounter(hQuery pdhHQuery, szFullCounterPath string, dwUserData uintptr, phCounter *pdhHCounter) error {
+	return pdhAddCounterProc(winPdhAddEnglishCounter, "PdhAddEnglishCounter", hQuery, szFullCounterPath, dwUserData, phCounter)
+}
+
+func pdhAddCounterProc(proc *syscall.LazyProc, op string, hQuery pdhHQuery, szFullCounterPath string, dwUserData uintptr, phCounter *pdhHCounter) error {
+	ptxt, err := syscall.UTF16PtrFromString(szFullCounterPath)
+	if err != nil {
+		return err
+	}
+	r0, _, _ := proc.Call(
+		uintptr(hQuery),
+		uintptr(unsafe.Pointer(ptxt)),
+		dwUserData,
+		uintptr(unsafe.Pointer(phCounter)))
+
+	if r0 != 0 {
+		return &PdhError{Op: op, Code: uint32(r0)}
+	}
+	return nil
+}
+
+func pdhOpenQuery(datasrc *uint16, userdata uint32, query *pdhHQuery) error {
+	r0, _, _ := syscall.Syscall(winPdhOpenQuery.Addr(), 3, 0 /*uintptr(unsafe.Pointer(datasrc))*/, uintptr(userdata), uintptr(unsafe.Pointer(query)))
+	if r0 != 0 {
+		return &PdhError{Op: "PdhOpenQuery", Code: uint32(r0)}
+	}
+	return nil
+}
+
+func pdhCloseQuery(hQuery pdhHQuery) error {
+	r0, _, _ := winPdhCloseQuery.Call(uintptr(hQuery))
+	if r0 != 0 {
+		return &PdhError{Op: "PdhCloseQuery", Code: uint32(r0)}
+	}
+	return nil
+}
+
+func pdhCollectQueryData(hQuery pdhHQuery) error {
+	r0, _, _ := winPdhCollectQueryData.Call(uintptr(hQuery))
+	if r0 != 0 {
+		return &PdhError{Op: "PdhCollectQueryData", Code: uint32(r0)}
+	}
+	return nil
+}
+
+// pdhGetFormattedCounterArrayDouble formats the values as doubles, not
+// capping percentages at 100: the % Processor Time of a process is that of
+// a single cpu, and reaches 200 when it keeps two cpus busy.
+func pdhGetFormattedCounterArrayDouble(hCounter pdhHCounter, lpdwBufferSize *uint32, lpdwBufferCount *uint32, itemBuffer *pdhFmtCounterValueItemDouble) uint32 {
+	ret, _, _ := winPdhGetFormattedCounterArray.Call(
+		uintptr(hCounter),
+		uintptr(pdhFmtDouble|pdhFmtNoCap100),
+		uintptr(unsafe.Pointer(lpdwBufferSize)),
+		uintptr(unsafe.Pointer(lpdwBufferCount)),
+		uintptr(unsafe.Pointer(itemBuffer)))
+
+	return uint32(ret)
+}
+
+func pdhGetRawCounterArray(hCounter pdhHCounter, lpdwBufferSize *uint32, lpdwItemCount *uint32, itemBuffer *pdhRawCounterItem) uint32 {
+	ret, _, _ := winPdhGetRawCounterArray.Call(
+		uintptr(hCounter),
+		uintptr(unsafe.Pointer(lpdwBufferSize)),
+		uintptr(unsafe.Pointer(lpdwItemCount)),
+		uintptr(unsafe.Pointer(itemBuffer)))
+
+	return uint32(ret)
+}
+
+// pdhCounterValue is the formatted value of a counter for one instance.
+// Valid is false when the item status reports no valid data.
+type pdhCounterValue struct {
+	Name  string
+	Value float64
+	Valid bool
+}
+
+// utf16PtrToString converts a null terminated UTF-16 string.
+func utf16PtrToString(p *uint16) string {
+	if p == nil {
+		return ""
+	}
+	n := 0
+	for ptr := unsafe.Pointer(p); *(*uint16)(ptr) != 0; n++ {
+		ptr = unsafe.Add(ptr, unsafe.Sizeof(*p))
+	}
+	return syscall.UTF16ToString(unsafe.Slice(p, n))
+}
+
+// getCounterArray calls a PDH array function until it fills a buffer, and
+// returns the buffer and the count of items.  The buffer receives the items
+// followed by the instance names they point to.  It is sized from the byte
+// count returned by PDH, which may grow between calls, and is made of
+// uint64 for alignment and so that the garbage collector does not scan the
+// names as pointers.
+func getCounterArray(op string, get func(bufSize, bufCount *uint32, items unsafe.Pointer) uint32) ([]uint64, uint32, error) {
+	var bufSize uint32
+	var bufCount uint32
+
+	var buf []uint64
+	var ret uint32
+	for i := 0; i < maxArrayAttempts; i++ {
+		var items unsafe.Pointer
+		if len(buf) > 0 {
+			items = unsafe.Pointer(&buf[0])
+		}
+		ret = get(&bufSize, &bufCount, items)
+		if ret != PDH_MORE_DATA {
+			break
+		}
+		buf = make([]uint64, (uintptr(bufSize)+7)/8)
+	}
+	if ret != 0 {
+		return nil, 0, &PdhError{Op: op, Code: ret}
+	}
+	if bufCount == 0 || len(buf) == 0 {
+		return nil, 0, nil
+	}
+	return buf, bufCount, nil
+}
+
+// instanceNamer names the instances of an array.  The array names every
+// instance of an image alike, so repeated names are numbered <name>#<n> in
+// the order they appear, as perfmon does.
+type instanceNamer map[string]int
+
+func (seen instanceNamer) name(p *uint16) string {
+	// copy the name out of the buffer
+	name := utf16PtrToString(p)
+	if n := seen[name]; n > 0 {
+		seen[name] = n + 1
+		return fmt.Sprintf("%s#%d", name, n)
+	}
+	seen[name] = 1
+	return name
+}
+
+func validStatus(status uint32) bool {
+	return status == PDH_CSTATUS_VALID_DATA || status == PDH_CSTATUS_NEW_DATA
+}
+
+// getCounterArrayData returns the formatted values of a wildcard counter,
+// with the name of their instance.
+func getCounterArrayData(counter pdhHCounter) ([]pdhCounterValue, error) {
+	buf, count, err := getCounterArray("PdhGetFormattedCounterArray", func(bufSize, bufCount *uint32, items unsafe.Pointer) uint32 {
+		return pdhGetFormattedCounterArrayDouble(counter, bufSize, bufCount, (*pdhFmtCounterValueItemDouble)(items))
+	})
+	if err != nil || count == 0 {
+		return nil, err
+	}
+
+	items := unsafe.Slice((*pdhFmtCounterValueItemDouble)(unsafe.Pointer(&buf[0])), count)
+	rv := make([]pdhCounterValue, count)
+	seen := make(instanceNamer, count)
+	for i := range items {
+		rv[i] = pdhCounterValue{
+			Name:  seen.name(items[i].SzName),
+			Value: items[i].FmtValue.DoubleValue,
+			Valid: validStatus(items[i].FmtValue.CStatus),
+		}
+	}
+	runtime.KeepAlive(buf)
+
+	return rv, nil
+}
+
+// getRawTimerArrayData returns the raw values of a wildcard 100ns timer
+// counter, such as % Processor Time, as the seconds counted since the
+// instance started, with the name of their instance.
+func getRawTimerArrayData(counter pdhHCounter) ([]pdhCounterValue, error) {
+	buf, count, err := getCounterArray("PdhGetRawCounterArray", func(bufSize, bufCount *uint32, items unsafe.Pointer) uint32 {
+		return pdhGetRawCounterArray(counter, bufSize, bufCount, (*pdhRawCounterItem)(items))
+	})
+	if err != nil || count == 0 {
+		return nil, err
+	}
+
+	items := unsafe.Slice((*pdhRawCounterItem)(unsafe.Pointer(&buf[0])), count)
+	rv := make([]pdhCounterValue, count)
+	seen := make(instanceNamer, count)
+	for i := range items {
+		rv[i] = pdhCounterValue{
+			Name:  seen.name(items[i].SzName),
+			Value: (time.Duration(items[i].RawValue.FirstValue) * 100).Seconds(),
+			Valid: validStatus(items[i].RawValue.CStatus),
+		}
+	}
+	runtime.KeepAlive(buf)
+
+	return rv, nil
+}
+
+func init() {
+	Register("pdh", openPdhBackend)
+	defaultBackend = "pdh"
+}
+
+// Performance objects of the processes.  The instances of Process V2,
+// available on recent Windows versions, are named <image>:<pid> and so
+// identify their process.  Those of Process are named <image>#<n>, n
+// following the order of the instances, which may differ between the
+// arrays of two counters as processes start and exit.
+const (
+	processObject   = "Process"
+	processV2Object = "Process V2"
+)
+
+// maximum attempts at collecting Process counter arrays that list the
+// same instances.
+const maxSnapshotAttempts = 3
+
+// errInstancesChanged is returned when the counter arrays keep listing
+// different instances.
+var errInstancesChanged = errors.New("pse: process instances changed while sampling")
+
+// pdhBackend retrieves process usage through the performance counter
+// (pdh.dll) API.
+type pdhBackend struct {
+	opts       *Options
+	query      pdhHQuery
+	object     string
+	pidCounter pdhHCounter
+
+	// counters of processCounterSet
+	counters [len(processCounterSet)]pdhHCounter
+
+	// addCounterAPI is the PDH function the counters were added with.
+	addCounterAPI string
+
+	cpu *counterCPU
+}
+
+func openPdhBackend(opts *Options) (Backend, error) {
+	b := &pdhBackend{opts: opts, cpu: newCounterCPU(opts)}
+	if err := b.initCounters(); err != nil {
+		if b.query != 0 {
+			pdhCloseQuery(b.query)
+		}
+		return nil, err
+	}
+	return b, nil
+}
+
+// initialize our counters
+func (b *pdhBackend) initCounters() (err error) {
+	// require an addressible nil pointer
+	var source uint16
+	if err := pdhOpenQuery(&source, 0, &b.query); err != nil {
+		return err
+	}
+
+	// English counter names work on every system, but older ones only
+	// take names in their own language, translated with the locale of
+	// the options if any.
+	addCounter := pdhAddEnglishCounter
+	b.addCounterAPI = "PdhAddEnglishCounterW"
+	locale := &TypeperfLocale{}
+	if winPdhAddEnglishCounter.Find() != nil {
+		addCounter = pdhAddCounter
+		b.addCounterAPI = "PdhAddCounterW"
+		if b.opts.TypeperfLocale != nil {
+			locale = b.opts.TypeperfLocale
+		}
+	}
+
+	// setup the performance counters of every instance of the image,
+	// from Process V2 where available.
+	b.object = processV2Object
+	if err = b.addCounters(addCounter, locale); err != nil {
+		pdhCloseQuery(b.query)
+		b.query = 0
+		if err = pdhOpenQuery(&source, 0, &b.query); err != nil {
+			return err
+		}
+		b.object = processObject
+		if err = b.addCounters(addCounter, locale); err != nil {
+			return err
+		}
+	}
+
+	// prime the counters by collecting once: rate counters such as
+	// % Processor Time are computed between two collections, so that the
+	// first sample measures the time since the backend was opened.
+	return pdhCollectQueryData(b.query)
+}
+
+// addCounters adds the counters of every instance of the image, in the
+// object of the backend.
+func (b *pdhBackend) addCounters(addCounter func(pdhHQuery, string, uintptr, *pdhHCounter) error, locale *TypeperfLocale) error {
+	path := func(counter string) string {
+		p := CounterPath{Object: b.object, Instance: b.opts.ImageName + "*", Counter: counter}
+		return locale.LocalPath(p.String())
+	}
+	if err := addCounter(b.query, path("ID Process"), 0, &b.pidCounter); err != nil {
+		return err
+	}
+	for i, pc := range processCounterSet {
+		if err := addCounter(b.query, path(pc.name), 0, &b.counters[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// UsageForPID implements Backend.  The pid is matched against the
+// ID Process counter of every instance.
+func (b *pdhBackend) UsageForPID(pid int) (Usage, error) {
+	usages, err := b.SnapshotAll()
+	if err != nil {
+		return Usage{}, err
+	}
+	u, ok := usages[pid]
+	if !ok {
+		return Usage{}, ErrNotFound
+	}
+	return u, nil
+}
+
+// SnapshotAll implements Backend, collecting the counters of every
+// instance with a single query.  Counters are joined by instance name, so
+// that an instance missing from one of them, or without valid data, has
+// that metric reported as missing rather than mixed up with another.
+// Process instance names only identify a process if every array lists
+// the same instances in the same order, so they are collected again
+// otherwise.
+func (b *pdhBackend) SnapshotAll() (map[int]Usage, error) {
+	var pidAry []pdhCounterValue
+	var arys [len(processCounterSet)][]pdhCounterValue
+	var err error
+	for i := 0; ; i++ {
+		if i == maxSnapshotAttempts {
+			return nil, errInstancesChanged
+		}
+		if pidAry, arys, err = b.collect(); err != nil {
+			return nil, err
+		}
+		if b.object == processV2Object || sameInstances(pidAry, arys[:]) {
+			break
+		}
+	}
+
+	now := time.Now()
+	var values [len(processCounterSet)]map[string]float64
+	for i, ary := range arys {
+		values[i] = validValuesByName(ary)
+	}
+
+	// assign values from the performance counters
+	usages := make(map[int]Usage, len(pidAry))
+	for _, p := range pidAry {
+		u := Usage{Time: now, Collected: now}
+		if b.object == processV2Object {
+			image, pid, ok := splitProcessV2Instance(p.Name)
+			if !ok || !b.opts.matchImage(image) {
+				continue
+			}
+			u.PID = pid
+		} else {
+			// the query matches every image starting with the name,
+			// and an instance cannot be identified without its pid.
+			if !b.opts.matchImage(p.Name) || !p.Valid {
+				continue
+			}
+			u.PID = int(p.Value)
+		}
+		for i, pc := range processCounterSet {
+			if v, ok := values[i][p.Name]; ok {
+				pc.set(&u, v)
+				u.Valid |= pc.metric
+			}
+		}
+		usages[u.PID] = u
+	}
+	b.cpu.convertAll(usages)
+	return usages, nil
+}
+
+// collect refreshes the counters and returns their arrays.
+func (b *pdhBackend) collect() (pidAry []pdhCounterValue, arys [len(processCounterSet)][]pdhCounterValue, err error) {
+	if err = pdhCollectQueryData(b.query); err != nil {
+		return nil, arys, err
+	}
+	if pidAry, err = getCounterArrayData(b.pidCounter); err != nil {
+		return nil, arys, err
+	}
+	for i, counter := range b.counters {
+		// the formatted cpu counters are the percentage of the last
+		// interval, while the raw ones count the cpu time used.
+		get := getCounterArrayData
+		if b.opts.CPUMode == CPUSecondsTotal && processCounterSet[i].metric&cpuMetrics != 0 {
+			get = getRawTimerArrayData
+		}
+		if arys[i], err = get(counter); err != nil {
+			return nil, arys, err
+		}
+	}
+	return pidAry, arys, nil
+}
+
+// sameInstances reports whether every array lists the instances of the
+// ID Process array, in the same order.
+func sameInstances(pidAry []pdhCounterValue, arys [][]pdhCounterValue) bool {
+	for _, ary := range arys {
+		if len(ary) != len(pidAry) {
+			return false
+		}
+		for i := range ary {
+			if ary[i].Name != pidAry[i].Name {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// validValuesByName indexes the valid counter values by instance name.
+func validValuesByName(values []pdhCounterValue) map[string]float64 {
+	m := make(map[string]float64, len(values))
+	for _, v := range values {
+		if v.Valid {
+			m[v.Name] = v.Value
+		}
+	}
+	return m
+}
+
+// Diagnostics implements Diagnoser, reporting the PDH function the
+// counters were added with, and their performance object.
+func (b *pdhBackend) Diagnostics() map[string]string {
+	return map[string]string{
+		"pdh.addcounter": b.addCounterAPI,
+		"pdh.object":     b.object,
+	}
+}
+
+// Close implements Backend, releasing the query and its counters.
+func (b *pdhBackend) Close() error {
+	return pdhCloseQuery(b.query)
+}
@@ -0,0 +1,134 @@
+package pse
+
+import (
+	"errors"
+	"fmt"
+)
+
+// PDH status codes.  They are defined on every platform so that callers
+// can match PDH errors without build constraints.
+const (
+	PDH_CSTATUS_VALID_DATA         = 0x00000000
+	PDH_CSTATUS_NEW_DATA           = 0x00000001
+	PDH_CSTATUS_NO_MACHINE         = 0x800007D0
+	PDH_CSTATUS_NO_INSTANCE        = 0x800007D1
+	PDH_MORE_DATA                  = 0x800007D2
+	PDH_CSTATUS_ITEM_NOT_VALIDATED = 0x800007D3
+	PDH_RETRY                      = 0x800007D4
+	PDH_NO_DATA                    = 0x800007D5
+	PDH_CALC_NEGATIVE_DENOMINATOR  = 0x800007D6
+	PDH_CALC_NEGATIVE_TIMEBASE     = 0x800007D7
+	PDH_CALC_NEGATIVE_VALUE        = 0x800007D8
+	PDH_CSTATUS_NO_OBJECT          = 0xC0000BB8
+	PDH_CSTATUS_NO_COUNTER         = 0xC0000BB9
+	PDH_CSTATUS_INVALID_DATA       = 0xC0000BBA
+	PDH_MEMORY_ALLOCATION_FAILURE  = 0xC0000BBB
+	PDH_INVALID_HANDLE             = 0xC0000BBC
+	PDH_INVALID_ARGUMENT           = 0xC0000BBD
+	PDH_FUNCTION_NOT_FOUND         = 0xC0000BBE
+	PDH_CSTATUS_NO_COUNTERNAME     = 0xC0000BBF
+	PDH_CSTATUS_BAD_COUNTERNAME    = 0xC0000BC0
+	PDH_INVALID_BUFFER             = 0xC0000BC1
+	PDH_INSUFFICIENT_BUFFER        = 0xC0000BC2
+	PDH_CANNOT_CONNECT_MACHINE     = 0xC0000BC3
+	PDH_INVALID_PATH               = 0xC0000BC4
+	PDH_INVALID_INSTANCE           = 0xC0000BC5
+	PDH_INVALID_DATA               = 0xC0000BC6
+	PDH_NO_DIALOG_DATA             = 0xC0000BC7
+	PDH_CANNOT_READ_NAME_STRINGS   = 0xC0000BC8
+)
+
+// pdhMessages describes the PDH status codes.
+var pdhMessages = map[uint32]string{
+	PDH_CSTATUS_NEW_DATA:           "new data",
+	PDH_CSTATUS_NO_MACHINE:         "machine not found",
+	PDH_CSTATUS_NO_INSTANCE:        "instance not found",
+	PDH_MORE_DATA:                  "more data available",
+	PDH_CSTATUS_ITEM_NOT_VALIDATED: "item not validated",
+	PDH_RETRY:                      "retry",
+	PDH_NO_DATA:                    "no data",
+	PDH_CALC_NEGATIVE_DENOMINATOR:  "negative denominator",
+	PDH_CALC_NEGATIVE_TIMEBASE:     "negative time base",
+	PDH_CALC_NEGATIVE_VALUE:        "negative value",
+	PDH_CSTATUS_NO_OBJECT:          "object not found",
+	PDH_CSTATUS_NO_COUNTER:         "counter not found",
+	PDH_CSTATUS_INVALID_DATA:       "invalid counter data",
+	PDH_MEMORY_ALLOCATION_FAILURE:  "memory allocation failure",
+	PDH_INVALID_HANDLE:             "invalid handle",
+	PDH_INVALID_ARGUMENT:           "invalid argument",
+	PDH_FUNCTION_NOT_FOUND:         "function not found",
+	PDH_CSTATUS_NO_COUNTERNAME:     "no counter name",
+	PDH_CSTATUS_BAD_COUNTERNAME:    "bad counter name",
+	PDH_INVALID_BUFFER:             "invalid buffer",
+	PDH_INSUFFICIENT_BUFFER:        "insufficient buffer",
+	PDH_CANNOT_CONNECT_MACHINE:     "cannot connect to machine",
+	PDH_INVALID_PATH:               "invalid path",
+	PDH_INVALID_INSTANCE:           "invalid instance",
+	PDH_INVALID_DATA:               "invalid data",
+	PDH_NO_DIALOG_DATA:             "no dialog data",
+	PDH_CANNOT_READ_NAME_STRINGS:   "cannot read counter name strings",
+}
+
+// PdhError is a status code returned by a PDH function.  Use errors.Is
+// with the ErrPdh values to test for a given status, whatever the
+// operation.
+type PdhError struct {
+	Op   string // PDH function, eg: "PdhAddCounter"
+	Code uint32 // PDH status or Win32 error code
+}
+
+func (e *PdhError) Error() string {
+	msg, ok := pdhMessages[e.Code]
+	if !ok {
+		if err := errors.Unwrap(e); err != nil {
+			msg = err.Error()
+		} else {
+			msg = "unknown status"
+		}
+	}
+	if e.Op == "" {
+		return fmt.Sprintf("pdh: %s (0x%08X)", msg, e.Code)
+	}
+	return fmt.Sprintf("pdh: %s: %s (0x%08X)", e.Op, msg, e.Code)
+}
+
+// Is reports whether target is a PdhError with the same code.  The
+// operation of target is ignored when empty, as it is for the ErrPdh
+// values.
+func (e *PdhError) Is(target error) bool {
+	t, ok := target.(*PdhError)
+	if !ok {
+		return false
+	}
+	return t.Code == e.Code && (t.Op == "" || t.Op == e.Op)
+}
+
+// PDH errors, for use with errors.Is.
+var (
+	ErrPdhNoMachine               = &PdhError{Code: PDH_CSTATUS_NO_MACHINE}
+	ErrPdhNoInstance              = &PdhError{Code: PDH_CSTATUS_NO_INSTANCE}
+	ErrPdhMoreData                = &PdhError{Code: PDH_MORE_DATA}
+	ErrPdhItemNotValidated        = &PdhError{Code: PDH_CSTATUS_ITEM_NOT_VALIDATED}
+	ErrPdhRetry                   = &PdhError{Code: PDH_RETRY}
+	ErrPdhNoData                  = &PdhError{Code: PDH_NO_DATA}
+	ErrPdhNegativeDenominator     = &PdhError{Code: PDH_CALC_NEGATIVE_DENOMINATOR}
+	ErrPdhNegativeTimebase        = &PdhError{Code: PDH_CALC_NEGATIVE_TIMEBASE}
+	ErrPdhNegativeValue           = &PdhError{Code: PDH_CALC_NEGATIVE_VALUE}
+	ErrPdhNoObject                = &PdhError{Code: PDH_CSTATUS_NO_OBJECT}
+	ErrPdhNoCounter               = &PdhError{Code: PDH_CSTATUS_NO_COUNTER}
+	ErrPdhInvalidCounterData      = &PdhError{Code: PDH_CSTATUS_INVALID_DATA}
+	ErrPdhMemoryAllocationFailure = &PdhError{Code: PDH_MEMORY_ALLOCATION_FAILURE}
+	ErrPdhInvalidHandle           = &PdhError{Code: PDH_INVALID_HANDLE}
+	ErrPdhInvalidArgument         = &PdhError{Code: PDH_INVALID_ARGUMENT}
+	ErrPdhFunctionNotFound        = &PdhError{Code: PDH_FUNCTION_NOT_FOUND}
+	ErrPdhNoCounterName           = &PdhError{Code: PDH_CSTATUS_NO_COUNTERNAME}
+	ErrPdhBadCounterName          = &PdhError{Code: PDH_CSTATUS_BAD_COUNTERNAME}
+	ErrPdhInvalidBuffer           = &PdhError{Code: PDH_INVALID_BUFFER}
+	ErrPdhInsufficientBuffer      = &PdhError{Code: PDH_INSUFFICIENT_BUFFER}
+	ErrPdhCannotConnectMachine    = &PdhError{Code: PDH_CANNOT_CONNECT_MACHINE}
+	ErrPdhInvalidPath             = &PdhError{Code: PDH_INVALID_PATH}
+	ErrPdhInvalidInstance         = &PdhError{Code: PDH_INVALID_INSTANCE}
+	ErrPdhInvalidData             = &PdhError{Code: PDH_INVALID_DATA}
+	ErrPdhNoDialogData            = &PdhError{Code: PDH_NO_DIALOG_DATA}
+	ErrPdhCannotReadNameStrings   = &PdhError{Code: PDH_CANNOT_READ_NAME_STRINGS}
+)
@@ -0,0 +1,67 @@
+package pse
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestPdhErrorIs(t *testing.T) {
+	err := &PdhError{Op: "PdhAddCounter", Code: PDH_CSTATUS_NO_COUNTER}
+	tests := []struct {
+		err    error
+		target error
+		want   bool
+	}{
+		{err, ErrPdhNoCounter, true},
+		{fmt.Errorf("adding counter: %w", err), ErrPdhNoCounter, true},
+		{err, ErrPdhNoObject, false},
+		{err, &PdhError{Op: "PdhAddCounter", Code: PDH_CSTATUS_NO_COUNTER}, true},
+		{err, &PdhError{Op: "PdhAddEnglishCounter", Code: PDH_CSTATUS_NO_COUNTER}, false},
+		{err, errors.New("pdh: PdhAddCounter: counter not found (0xC0000BB9)"), false},
+		{ErrPdhNoCounter, err, false},
+	}
+	for i, tt := range tests {
+		if got := errors.Is(tt.err, tt.target); got != tt.want {
+			t.Errorf("%d: errors.Is(%v, %v) = %v, want %v", i, tt.err, tt.target, got, tt.want)
+		}
+	}
+}
+
+func TestPdhErrorAs(t *testing.T) {
+	err := fmt.Errorf("collecting: %w", &PdhError{Op: "PdhCollectQueryData", Code: PDH_NO_DATA})
+	var pe *PdhError
+	if !errors.As(err, &pe) {
+		t.Fatalf("errors.As(%v) failed", err)
+	}
+	if pe.Op != "PdhCollectQueryData" || pe.Code != PDH_NO_DATA {
+		t.Errorf("got %+v", pe)
+	}
+	if errors.As(errors.New("pdh: no data"), &pe) {
+		t.Error("errors.As matched a plain error")
+	}
+}
+
+func TestPdhErrorString(t *testing.T) {
+	tests := []struct {
+		err  *PdhError
+		want string
+	}{
+		{&PdhError{Op: "PdhAddCounter", Code: PDH_CSTATUS_NO_COUNTER}, "pdh: PdhAddCounter: counter not found (0xC0000BB9)"},
+		{&PdhError{Code: PDH_CSTATUS_NO_INSTANCE}, "pdh: instance not found (0x800007D1)"},
+		{&PdhError{Op: "PdhCollectQueryData", Code: 0xC0000BFF}, "pdh: PdhCollectQueryData: unknown status (0xC0000BFF)"},
+		{&PdhError{Code: 0x800007FF}, "pdh: unknown status (0x800007FF)"},
+	}
+	for _, tt := range tests {
+		if got := tt.err.Error(); got != tt.want {
+			t.Errorf("got %q, want %q", got, tt.want)
+		}
+	}
+
+	// Win32 error codes are described by the system where it can
+	win32 := (&PdhError{Op: "PdhOpenQuery", Code: 5}).Error()
+	if !strings.HasPrefix(win32, "pdh: PdhOpenQuery: ") || !strings.HasSuffix(win32, " (0x00000005)") {
+		t.Errorf("got %q", win32)
+	}
+}
@@ -0,0 +1,12 @@
+package pse
+
+import "syscall"
+
+// Unwrap returns the Win32 error for codes that are not PDH status codes,
+// so that they match the syscall.Errno values.
+func (e *PdhError) Unwrap() error {
+	if e.Code > 0xFFFF {
+		return nil
+	}
+	return syscall.Errno(e.Code)
+}
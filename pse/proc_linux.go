@@ -0,0 +1,334 @@
+package pse
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+func init() {
+	Register("proc", openProcBackend)
+	defaultBackend = "proc"
+	selfImageName = readSelfComm
+}
+
+// readSelfComm returns the command name of the current process.  The
+// kernel names a process after the path it was executed through, which
+// differs from os.Executable when started through a symbolic link.
+func readSelfComm() (string, error) {
+	data, err := os.ReadFile("/proc/self/comm")
+	if err != nil {
+		return "", err
+	}
+	return string(bytes.TrimSuffix(data, []byte("\n"))), nil
+}
+
+// procBackend retrieves process usage from the /proc filesystem.
+type procBackend struct {
+	opts *Options
+	cpu  *CPUAccount
+
+	// boot time, which process start times are relative to
+	boot time.Time
+}
+
+func openProcBackend(opts *Options) (Backend, error) {
+	boot, err := readBootTime()
+	if err != nil {
+		return nil, err
+	}
+	return &procBackend{
+		opts: opts,
+		cpu:  &CPUAccount{Mode: opts.CPUMode, ReadSystem: readSystemCPUTimes},
+		boot: boot,
+	}, nil
+}
+
+// matchComm reports whether a command name matches the image name of the
+// options, allowing for the command name to have been truncated.
+func (b *procBackend) matchComm(comm string) bool {
+	if len(comm) == maxCommLen && len(b.opts.ImageName) > maxCommLen {
+		o := *b.opts
+		o.ImageName = o.ImageName[:maxCommLen]
+		return o.matchImage(comm)
+	}
+	return b.opts.matchImage(comm)
+}
+
+// clockTicks is the USER_HZ unit of the times of /proc, which is 100 on
+// every architecture but alpha.
+const clockTicks = 100
+
+// ticksDuration converts clock ticks to a duration.
+func ticksDuration(ticks uint64) time.Duration {
+	return time.Duration(ticks) * (time.Second / clockTicks)
+}
+
+var pageSize = int64(os.Getpagesize())
+
+// readSystemCPUTimes reads the cpu times of the system from /proc/stat.
+func readSystemCPUTimes() (CPUTimes, error) {
+	data, err := os.ReadFile("/proc/stat")
+	if err != nil {
+		return CPUTimes{}, err
+	}
+	return parseSystemCPUTimes(data)
+}
+
+// parseSystemCPUTimes parses the aggregate cpu line of /proc/stat:
+// cpu  user nice system idle iowait irq softirq steal guest guest_nice
+// guest and guest_nice are already accounted for in user and nice.  The
+// steal time, taken by the hypervisor from a virtual machine, is counted
+// as idle: the machine did not run.
+func parseSystemCPUTimes(data []byte) (CPUTimes, error) {
+	line := data
+	if i := bytes.IndexByte(data, '\n'); i >= 0 {
+		line = data[:i]
+	}
+	fields := bytes.Fields(line)
+	if len(fields) < 5 || string(fields[0]) != "cpu" {
+		return CPUTimes{}, fmt.Errorf("unexpected /proc/stat format: %q", line)
+	}
+	var ticks [8]uint64
+	for i := 1; i < len(fields) && i <= len(ticks); i++ {
+		var err error
+		if ticks[i-1], err = strconv.ParseUint(string(fields[i]), 10, 64); err != nil {
+			return CPUTimes{}, fmt.Errorf("unable to parse /proc/stat: %v", err)
+		}
+	}
+	return CPUTimes{
+		User:   ticksDuration(ticks[0] + ticks[1]),
+		Kernel: ticksDuration(ticks[2] + ticks[5] + ticks[6]),
+		Idle:   ticksDuration(ticks[3] + ticks[4] + ticks[7]),
+	}, nil
+}
+
+// readBootTime reads the boot time from /proc/stat.
+func readBootTime() (time.Time, error) {
+	data, err := os.ReadFile("/proc/stat")
+	if err != nil {
+		return time.Time{}, err
+	}
+	return parseBootTime(data)
+}
+
+// parseBootTime parses the btime line of /proc/stat, the boot time in
+// seconds since the epoch.
+func parseBootTime(data []byte) (time.Time, error) {
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		fields := bytes.Fields(line)
+		if len(fields) == 2 && string(fields[0]) == "btime" {
+			secs, err := strconv.ParseInt(string(fields[1]), 10, 64)
+			if err != nil {
+				return time.Time{}, fmt.Errorf("unable to parse btime: %v", err)
+			}
+			return time.Unix(secs, 0), nil
+		}
+	}
+	return time.Time{}, errors.New("no btime in /proc/stat")
+}
+
+// maxCommLen is the length at which the kernel truncates command names.
+const maxCommLen = 15
+
+// readProcessStat parses the command name, and the utime, stime and
+// starttime fields of /proc/[pid]/stat into a reading.  The command name
+// is in parentheses and may contain spaces, so fields are counted from the
+// last closing parenthesis.
+func (b *procBackend) readProcessStat(pid int, comm *string, r *CPUReading) error {
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return err
+	}
+	i := bytes.LastIndexByte(data, ')')
+	j := bytes.IndexByte(data, '(')
+	if i < 0 || j < 0 || j > i {
+		return fmt.Errorf("unexpected /proc/%d/stat format", pid)
+	}
+	*comm = string(data[j+1 : i])
+	// fields[0] is the state, the third field of the file.  utime and
+	// stime are the fourteenth and fifteenth, starttime the twenty second.
+	fields := bytes.Fields(data[i+1:])
+	if len(fields) < 20 {
+		return fmt.Errorf("unexpected /proc/%d/stat format", pid)
+	}
+	utime, err := strconv.ParseUint(string(fields[11]), 10, 64)
+	if err != nil {
+		return fmt.Errorf("unable to parse utime: %v", err)
+	}
+	stime, err := strconv.ParseUint(string(fields[12]), 10, 64)
+	if err != nil {
+		return fmt.Errorf("unable to parse stime: %v", err)
+	}
+	starttime, err := strconv.ParseUint(string(fields[19]), 10, 64)
+	if err != nil {
+		return fmt.Errorf("unable to parse starttime: %v", err)
+	}
+	r.Proc.User = ticksDuration(utime)
+	r.Proc.Kernel = ticksDuration(stime)
+	r.Start = b.boot.Add(ticksDuration(starttime))
+	return nil
+}
+
+// readProcessMemory parses /proc/[pid]/statm for the memory of a process
+// in bytes, and returns the metrics it sets:
+// size resident shared text lib data dt
+// The private working set is the resident memory not backed by files or
+// shared memory, and the private bytes are the data and stack.
+func readProcessMemory(pid int, m *Memory) (Metrics, error) {
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/statm", pid))
+	if err != nil {
+		return 0, err
+	}
+	fields := bytes.Fields(data)
+	if len(fields) < 6 {
+		return 0, fmt.Errorf("unexpected /proc/%d/statm format", pid)
+	}
+	var pages [6]int64
+	for i := range pages {
+		if pages[i], err = strconv.ParseInt(string(fields[i]), 10, 64); err != nil {
+			return 0, fmt.Errorf("unable to parse /proc/%d/statm: %v", pid, err)
+		}
+	}
+	m.Virtual = pages[0] * pageSize
+	m.WorkingSet = pages[1] * pageSize
+	m.PrivateWorkingSet = (pages[1] - pages[2]) * pageSize
+	m.PrivateBytes = pages[5] * pageSize
+	return MetricVirtual | MetricWorkingSet | MetricPrivateWorkingSet | MetricPrivateBytes, nil
+}
+
+// readProcessPeaks parses the VmPeak and VmHWM lines of /proc/[pid]/status
+// for the peak virtual and resident sizes, and returns the metrics it sets.
+// Kernel threads have neither.
+func readProcessPeaks(pid int, m *Memory) (Metrics, error) {
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/status", pid))
+	if err != nil {
+		return 0, err
+	}
+	var valid Metrics
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		var v *int64
+		var metric Metrics
+		switch {
+		case bytes.HasPrefix(line, []byte("VmPeak:")):
+			v, metric = &m.PeakVirtual, MetricPeakVirtual
+		case bytes.HasPrefix(line, []byte("VmHWM:")):
+			v, metric = &m.PeakWorkingSet, MetricPeakWorkingSet
+		default:
+			continue
+		}
+		// eg: VmPeak:	   12345 kB
+		fields := bytes.Fields(line)
+		if len(fields) != 3 || string(fields[2]) != "kB" {
+			return 0, fmt.Errorf("unexpected /proc/%d/status format: %q", pid, line)
+		}
+		kb, err := strconv.ParseInt(string(fields[1]), 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("unable to parse /proc/%d/status: %v", pid, err)
+		}
+		*v = kb * 1024
+		valid |= metric
+	}
+	return valid, nil
+}
+
+// UsageForPID implements Backend.  The process is not found if its
+// command name does not match the image name of the options.
+func (b *procBackend) UsageForPID(pid int) (Usage, error) {
+	sys, err := b.cpu.SystemReading()
+	if err != nil {
+		return Usage{}, err
+	}
+	return b.usage(pid, sys)
+}
+
+// SnapshotAll implements Backend, scanning /proc for matching processes.
+func (b *procBackend) SnapshotAll() (map[int]Usage, error) {
+	sys, err := b.cpu.SystemReading()
+	if err != nil {
+		return nil, err
+	}
+
+	d, err := os.Open("/proc")
+	if err != nil {
+		return nil, err
+	}
+	names, err := d.Readdirnames(-1)
+	d.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	usages := make(map[int]Usage)
+	for _, name := range names {
+		pid, err := strconv.Atoi(name)
+		if err != nil {
+			continue
+		}
+		u, err := b.usage(pid, sys)
+		// processes of other users may not be readable, as when /proc
+		// is mounted with hidepid
+		if err == ErrNotFound || os.IsPermission(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		usages[pid] = u
+	}
+
+	// forget the processes that are gone
+	b.cpu.Retain(func(pid int) bool {
+		_, ok := usages[pid]
+		return ok
+	})
+	return usages, nil
+}
+
+// usage samples a process along with the given system reading.
+func (b *procBackend) usage(pid int, r CPUReading) (Usage, error) {
+	u := Usage{PID: pid, Time: r.Time, Collected: r.Time}
+
+	var comm string
+	err := b.readProcessStat(pid, &comm, &r)
+	if err == nil && !b.matchComm(comm) {
+		err = ErrNotFound
+	}
+	var mem, peaks Metrics
+	if err == nil {
+		mem, err = readProcessMemory(pid, &u.Memory)
+	}
+	if err == nil {
+		peaks, err = readProcessPeaks(pid, &u.Memory)
+	}
+	if err != nil {
+		b.cpu.Forget(pid)
+		// a process that exits while being read has no files, or
+		// fails its reads with ESRCH
+		if os.IsNotExist(err) || errors.Is(err, syscall.ESRCH) {
+			return Usage{}, ErrNotFound
+		}
+		return Usage{}, err
+	}
+
+	u.Valid = mem | peaks
+
+	// The first sample only establishes a baseline.
+	if cpu, ok := b.cpu.Update(pid, r); ok {
+		u.CPU = cpu.Total
+		u.UserCPU = cpu.User
+		u.KernelCPU = cpu.Kernel
+		u.Valid |= MetricCPU | MetricUserCPU | MetricKernelCPU
+	}
+
+	return u, nil
+}
+
+// Close implements Backend.
+func (b *procBackend) Close() error {
+	return nil
+}
@@ -0,0 +1,97 @@
+package pse
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestProcUsageThroughSymlink runs the test binary through a symbolic link
+// of another name, which the kernel names the process after, and checks
+// that it samples itself with the default image name.
+func TestProcUsageThroughSymlink(t *testing.T) {
+	if os.Getenv("PSE_TEST_SELF") == "1" {
+		s, err := NewSampler(&Options{Backend: "proc"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+		if _, err := s.UsageForPID(os.Getpid()); err != nil {
+			t.Fatalf("image %q: %v", s.opts.ImageName, err)
+		}
+		return
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	link := filepath.Join(t.TempDir(), "gnatsd")
+	if err := os.Symlink(exe, link); err != nil {
+		t.Skip(err)
+	}
+	cmd := exec.Command(link, "-test.run=^TestProcUsageThroughSymlink$")
+	cmd.Env = append(os.Environ(), "PSE_TEST_SELF=1")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("%v\n%s", err, out)
+	}
+}
+
+// The /proc fixtures under testdata were captured on a single cpu Linux
+// 6.18 virtual machine, whose hypervisor took some of its time.
+
+func TestParseSystemCPUTimes(t *testing.T) {
+	data, err := os.ReadFile("testdata/proc_stat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := parseSystemCPUTimes(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := CPUTimes{
+		User:   ticksDuration(79121),
+		Kernel: ticksDuration(18127 + 22),
+		Idle:   ticksDuration(330950 + 438 + 15370), // steal is idle
+	}
+	if got != want {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	// kernels older than 2.6.11 have no steal column
+	got, err = parseSystemCPUTimes([]byte("cpu  4705 356 584 3699 23 23 0\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (CPUTimes{User: ticksDuration(5061), Kernel: ticksDuration(607), Idle: ticksDuration(3722)}); got != want {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	for _, data := range []string{"", "cpu0 4705 356 584 3699\n", "cpu  4705 -356 584 3699\n"} {
+		if _, err := parseSystemCPUTimes([]byte(data)); err == nil {
+			t.Errorf("%q: no error", data)
+		}
+	}
+}
+
+func TestParseBootTime(t *testing.T) {
+	data, err := os.ReadFile("testdata/proc_stat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := parseBootTime(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := time.Unix(1792189105, 0); !got.Equal(want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	for _, data := range []string{"cpu  4705 356 584 3699\n", "btime now\n"} {
+		if _, err := parseBootTime([]byte(data)); err == nil {
+			t.Errorf("%q: no error", data)
+		}
+	}
+}
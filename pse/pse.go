@@ -0,0 +1,556 @@
+// Package pse retrieves process usage information (percent cpu, resident
+// and virtual memory) for the current process, or any other process by pid.
+//
+// The work is done by a Backend.  Several backends are registered by name,
+// depending on the platform, and one of them is selected as the default:
+//
+//	pdh       Windows performance counters through pdh.dll (default on Windows)
+//	nopc      GetProcessTimes and GetProcessMemoryInfo, no performance counters
+//	typeperf  the typeperf command line utility
+//	proc      the /proc filesystem (default on Linux)
+//	replay    a recorded typeperf or relog CSV log, on every platform
+//
+// A Sampler owns an instance of a backend along with its cpu baseline and
+// cached results.  ProcUsage uses a package level Sampler for convenience.
+package pse
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Usage is a process usage sample.
+type Usage struct {
+	PID int     // process id
+	CPU float64 // percent cpu, or cpu seconds, as selected by the CPUMode
+	RSS int64   // resident set size, in bytes, as selected by the options
+	VSS int64   // virtual memory size, in bytes, as selected by the options
+
+	// UserCPU and KernelCPU are the parts of CPU spent in user and in
+	// kernel (privileged) mode, in the same unit.
+	UserCPU   float64
+	KernelCPU float64
+
+	// MemPercent is RSS as a percentage of the physical memory, as the
+	// %MEM of ps.
+	MemPercent float64
+
+	// Memory holds every memory metric reported by the backend.
+	Memory Memory
+
+	// Time is the time of the sample, as reported by the source when it
+	// timestamps its samples.
+	Time time.Time
+
+	// Collected is the local time the sample was collected at.  It follows
+	// Time by the delay of the source, such as typeperf, and is equal to
+	// it for sources that do not timestamp their samples.
+	Collected time.Time
+
+	// Valid holds the metrics for which the sample has data.  Others are
+	// zero, which must not be taken for a measure: there is no cpu usage
+	// on the first sample of a process, and counters may have no data for
+	// an instance that just started or exited.
+	Valid Metrics
+
+	// Counters holds the values of the additional counters of the
+	// options, by metric name.  Counters without data are left out.
+	Counters map[string]float64
+}
+
+// Metrics is a set of usage metrics.
+type Metrics uint
+
+// Usage metrics
+const (
+	MetricCPU Metrics = 1 << iota
+	MetricRSS
+	MetricVSS
+	MetricUserCPU
+	MetricKernelCPU
+	MetricMemPercent
+)
+
+// Has reports whether every metric of m is in the set.
+func (set Metrics) Has(m Metrics) bool {
+	return set&m == m
+}
+
+// Backend is a source of process usage information.  A backend instance
+// is used by a single Sampler, which serializes calls to it.
+type Backend interface {
+	// UsageForPID returns the usage of the process with the given pid.
+	// The percent cpu is computed since the last call for the same pid.
+	UsageForPID(pid int) (Usage, error)
+
+	// SnapshotAll returns the usage of every process matching the image
+	// name of the options, by pid.
+	SnapshotAll() (map[int]Usage, error)
+
+	// Close releases any resources held by the backend.
+	Close() error
+}
+
+// Diagnoser is implemented by backends that report how they sample, as
+// returned by Sampler.Diagnostics.
+type Diagnoser interface {
+	Diagnostics() map[string]string
+}
+
+// OpenFunc creates a new instance of a backend.
+type OpenFunc func(opts *Options) (Backend, error)
+
+// DefaultMinInterval is the default minimum time between two samples
+// taken from a backend, so as to minimize impact on the server.
+const DefaultMinInterval = 2 * time.Second
+
+// Options configure a Sampler.
+type Options struct {
+	// Backend is the name of the backend to use.  If empty, the platform
+	// default is used.
+	Backend string
+
+	// CPUMode selects what the CPU of the usages reports, the per core
+	// percent cpu by default.  Backends that cannot report it fail to
+	// open with ErrCPUModeUnsupported.
+	CPUMode CPUMode
+
+	// LogicalCPUs is the number of logical cpus of the sampled machine,
+	// used to convert the per core percent cpu of performance counters.
+	// If zero, the number of logical cpus of this machine is used, not
+	// only those this process may run on, which must be overridden when
+	// replaying the log of another machine.
+	LogicalCPUs int
+
+	// RSSMetric and VSSMetric are the memory metrics reported as the RSS
+	// and VSS of the usages, eg: MetricPrivateBytes.  They default to
+	// MetricWorkingSet and MetricVirtual, the rss and vsz of ps.
+	RSSMetric Metrics
+	VSSMetric Metrics
+
+	// MemTotal is the physical memory of the sampled machine, in bytes,
+	// used to compute the MemPercent of the usages.  If zero, that of this
+	// machine is used, which must be overridden when replaying the log of
+	// another machine.
+	MemTotal int64
+
+	// MinInterval is the minimum time between two samples taken from the
+	// backend.  Requests made more often are answered from the last
+	// sample.  If zero, DefaultMinInterval is used; a negative value
+	// disables caching.
+	MinInterval time.Duration
+
+	// ImageName is the name of the process image to sample, without the
+	// .exe extension, eg: "gnatsd".  Performance counters name instances
+	// after their image, appending #<n> when several processes share it.
+	// Processes with another image are not found.  If empty, the image
+	// name of the current process is used.
+	ImageName string
+
+	// Wildcard treats ImageName as a prefix, matching every image whose
+	// name starts with it.
+	Wildcard bool
+
+	// StreamInterval, if set, has the typeperf backend run a single long
+	// lived typeperf sampling at this interval, rather than a typeperf
+	// process per sample.
+	StreamInterval time.Duration
+
+	// TypeperfLocale is the locale of the typeperf output.  If nil, the
+	// en-US locale is assumed.  Its counter names are also used by the pdh
+	// backend on systems without PdhAddEnglishCounterW.
+	TypeperfLocale *TypeperfLocale
+
+	// Runner runs the typeperf commands of the typeperf backend, whether
+	// streaming or not.  If nil, they are run with os/exec.
+	Runner Runner
+
+	// TypeperfCounters are additional counters sampled by the typeperf
+	// backend, such as handles or page faults.
+	TypeperfCounters []TypeperfCounter
+
+	// ReplayFile is the typeperf or relog CSV log read by the replay
+	// backend.  Each call to the backend returns its next sample, so
+	// caching is best disabled with a negative MinInterval.
+	ReplayFile string
+}
+
+// selfImageName returns the image name of the current process as the
+// system knows it, when that may differ from the name of its executable.
+// It is set by the platform specific files.
+var selfImageName func() (string, error)
+
+// defaultImageName returns the image name of the current process.
+func defaultImageName() string {
+	if selfImageName != nil {
+		if name, err := selfImageName(); err == nil {
+			return name
+		}
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		exe = os.Args[0]
+	}
+	name := filepath.Base(exe)
+	if ext := filepath.Ext(name); strings.EqualFold(ext, ".exe") {
+		name = name[:len(name)-len(ext)]
+	}
+	return name
+}
+
+// matchImage reports whether a process image or counter instance name,
+// such as "gnatsd" or "gnatsd#2", matches the options.  Names are compared
+// without regard to case, as they are on Windows.
+func (o *Options) matchImage(name string) bool {
+	if o.Wildcard {
+		return len(name) >= len(o.ImageName) &&
+			strings.EqualFold(name[:len(o.ImageName)], o.ImageName)
+	}
+	name, _, _ = splitInstanceIndex(name)
+	return strings.EqualFold(name, o.ImageName)
+}
+
+var (
+	// ErrNoBackend is returned when no backend is available on this
+	// platform.
+	ErrNoBackend = errors.New("pse: no backend available")
+
+	// ErrClosed is returned when using a closed Sampler.
+	ErrClosed = errors.New("pse: sampler closed")
+
+	// ErrNotFound is returned when the requested process cannot be found
+	// by the backend.
+	ErrNotFound = errors.New("pse: process not found")
+
+	// ErrCPUModeUnsupported is returned when the backend cannot report
+	// the cpu in the CPUMode of the options.
+	ErrCPUModeUnsupported = errors.New("pse: cpu mode not supported by the backend")
+)
+
+var (
+	backendsLock sync.Mutex
+	backends     = make(map[string]OpenFunc)
+
+	// defaultBackend is set by the platform specific files.
+	defaultBackend string
+)
+
+// Register makes a backend available by name.  It is intended to be called
+// from init functions, and panics if the name is registered twice.
+func Register(name string, open OpenFunc) {
+	backendsLock.Lock()
+	defer backendsLock.Unlock()
+
+	if open == nil {
+		panic("pse: Register open function is nil")
+	}
+	if _, dup := backends[name]; dup {
+		panic("pse: Register called twice for backend " + name)
+	}
+	backends[name] = open
+}
+
+// Backends returns the sorted names of the registered backends.
+func Backends() []string {
+	backendsLock.Lock()
+	defer backendsLock.Unlock()
+
+	names := make([]string, 0, len(backends))
+	for name := range backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// lookupBackend returns the backend of the given name, or the default
+// backend if the name is empty, along with its name.
+func lookupBackend(name string) (string, OpenFunc, error) {
+	backendsLock.Lock()
+	defer backendsLock.Unlock()
+
+	if name == "" {
+		if defaultBackend == "" {
+			return "", nil, ErrNoBackend
+		}
+		name = defaultBackend
+	}
+	open, ok := backends[name]
+	if !ok {
+		return "", nil, fmt.Errorf("pse: unknown backend %q", name)
+	}
+	return name, open, nil
+}
+
+// Sampler samples process usage through a backend.  It is safe for
+// concurrent use.
+type Sampler struct {
+	mu      sync.Mutex
+	opts    Options
+	backend Backend
+	closed  bool
+
+	// results of the last sample, per pid
+	samples map[int]*sample
+
+	// results of the last snapshot
+	snapshot *snapshot
+
+	// physical memory, for the MemPercent of the usages
+	memTotal int64
+
+	// system cpu times of the last UsageForSystem call
+	sysCPU *CPUTimes
+
+	// clock of the cached samples, replaced by tests
+	now func() time.Time
+}
+
+type sample struct {
+	time  time.Time
+	usage Usage
+	err   error
+}
+
+type snapshot struct {
+	time   time.Time
+	usages map[int]Usage
+	err    error
+}
+
+// NewSampler creates a Sampler with the given options, which may be nil.
+// The sampler must be closed when no longer needed.
+func NewSampler(opts *Options) (*Sampler, error) {
+	s := &Sampler{samples: make(map[int]*sample), now: time.Now}
+	if opts != nil {
+		s.opts = *opts
+	}
+	if s.opts.MinInterval == 0 {
+		s.opts.MinInterval = DefaultMinInterval
+	}
+	if s.opts.ImageName == "" {
+		s.opts.ImageName = defaultImageName()
+	}
+	s.memTotal = s.opts.MemTotal
+	if s.memTotal == 0 {
+		// without it, usages have no MemPercent
+		if mem, err := readSystemMemory(); err == nil {
+			s.memTotal = mem.total
+		}
+	}
+
+	name, open, err := lookupBackend(s.opts.Backend)
+	if err != nil {
+		return nil, err
+	}
+	s.opts.Backend = name
+	if s.backend, err = open(&s.opts); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// ProcUsage returns the percent cpu, resident set size and virtual memory
+// size of the current process.
+func (s *Sampler) ProcUsage(pcpu *float64, rss, vss *int64) error {
+	u, err := s.UsageForPID(os.Getpid())
+	*pcpu = u.CPU
+	*rss = u.RSS
+	*vss = u.VSS
+	return err
+}
+
+// UsageForPID returns the usage of the process with the given pid.  The
+// usage is zero on errors.
+func (s *Sampler) UsageForPID(pid int) (Usage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return Usage{}, ErrClosed
+	}
+
+	now := s.now()
+	last := s.samples[pid]
+	if last != nil && now.Sub(last.time) < s.opts.MinInterval {
+		return last.usage, last.err
+	}
+
+	// expired samples are of no use, drop them so that sampling many
+	// pids over time does not grow the cache.
+	for p, smp := range s.samples {
+		if now.Sub(smp.time) >= s.opts.MinInterval {
+			delete(s.samples, p)
+		}
+	}
+
+	// always save the sample time, even on errors.
+	last = &sample{time: now}
+	u, err := s.backend.UsageForPID(pid)
+	if err == nil {
+		s.opts.mapMemory(&u)
+		s.setMemPercent(&u)
+		last.usage = u
+	}
+	last.err = err
+	// a process that is gone is not cached
+	if err != ErrNotFound {
+		s.samples[pid] = last
+	}
+	return last.usage, last.err
+}
+
+// SnapshotAll returns the usage of every process matching the image name,
+// by pid.  All processes are sampled at once where the backend allows it.
+// The returned map belongs to the caller.
+func (s *Sampler) SnapshotAll() (map[int]Usage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return nil, ErrClosed
+	}
+
+	now := s.now()
+	last := s.snapshot
+	if last == nil || now.Sub(last.time) >= s.opts.MinInterval {
+		if last == nil {
+			last = &snapshot{}
+			s.snapshot = last
+		}
+		// always save the sample time, even on errors.
+		last.time = now
+		usages, err := s.backend.SnapshotAll()
+		if err == nil {
+			for pid, u := range usages {
+				s.opts.mapMemory(&u)
+				s.setMemPercent(&u)
+				usages[pid] = u
+			}
+			last.usages = usages
+		}
+		last.err = err
+	}
+	if last.err != nil {
+		return nil, last.err
+	}
+
+	usages := make(map[int]Usage, len(last.usages))
+	for pid, u := range last.usages {
+		usages[pid] = u
+	}
+	return usages, nil
+}
+
+// Diagnostics describes how the sampler samples, for troubleshooting: the
+// name of its backend under "backend", and the details reported by the
+// backend, such as the API used to add performance counters.
+func (s *Sampler) Diagnostics() map[string]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	diags := map[string]string{"backend": s.opts.Backend}
+	if d, ok := s.backend.(Diagnoser); ok {
+		for k, v := range d.Diagnostics() {
+			diags[k] = v
+		}
+	}
+	return diags
+}
+
+// Close releases the backend.  Closing a closed Sampler has no effect.
+func (s *Sampler) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	return s.backend.Close()
+}
+
+var (
+	stdLock    sync.Mutex
+	stdSampler *Sampler
+	stdBackend string
+)
+
+// SetBackend selects the backend used by ProcUsage, closing the sampler
+// in use if any.
+func SetBackend(name string) error {
+	if _, _, err := lookupBackend(name); err != nil {
+		return err
+	}
+
+	stdLock.Lock()
+	defer stdLock.Unlock()
+
+	stdBackend = name
+	if stdSampler != nil {
+		err := stdSampler.Close()
+		stdSampler = nil
+		return err
+	}
+	return nil
+}
+
+func defaultSampler() (*Sampler, error) {
+	stdLock.Lock()
+	defer stdLock.Unlock()
+
+	if stdSampler == nil {
+		s, err := NewSampler(&Options{Backend: stdBackend})
+		if err != nil {
+			return nil, err
+		}
+		stdSampler = s
+	}
+	return stdSampler, nil
+}
+
+// ProcUsage returns the percent cpu, resident set size and virtual memory
+// size of the current process using the selected backend.
+func ProcUsage(pcpu *float64, rss, vss *int64) error {
+	s, err := defaultSampler()
+	if err != nil {
+		return err
+	}
+	return s.ProcUsage(pcpu, rss, vss)
+}
+
+// UsageForPID returns the usage of the process with the given pid using
+// the selected backend.
+func UsageForPID(pid int) (Usage, error) {
+	s, err := defaultSampler()
+	if err != nil {
+		return Usage{}, err
+	}
+	return s.UsageForPID(pid)
+}
+
+// UsageForSystem returns the usage of the machine, the cpu being measured
+// since the previous call.
+func UsageForSystem() (SystemUsage, error) {
+	s, err := defaultSampler()
+	if err != nil {
+		return SystemUsage{}, err
+	}
+	return s.UsageForSystem()
+}
+
+// SnapshotAll returns the usage of every process matching the image name
+// of the current process, by pid, using the selected backend.
+func SnapshotAll() (map[int]Usage, error) {
+	s, err := defaultSampler()
+	if err != nil {
+		return nil, err
+	}
+	return s.SnapshotAll()
+}
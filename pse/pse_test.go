@@ -0,0 +1,226 @@
+package pse
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func init() {
+	Register("fake", func(opts *Options) (Backend, error) {
+		return &fakeBackend{usages: make(map[int]Usage), errs: make(map[int]error)}, nil
+	})
+}
+
+// fakeBackend returns the usages and errors set by a test, counting the
+// calls made to it.
+type fakeBackend struct {
+	usages    map[int]Usage
+	errs      map[int]error
+	calls     map[int]int
+	snapshots int
+	closes    int
+}
+
+func (b *fakeBackend) UsageForPID(pid int) (Usage, error) {
+	if b.calls == nil {
+		b.calls = make(map[int]int)
+	}
+	b.calls[pid]++
+	u := b.usages[pid]
+	if err, ok := b.errs[pid]; ok {
+		return u, err
+	}
+	if _, ok := b.usages[pid]; !ok {
+		return Usage{}, ErrNotFound
+	}
+	return u, nil
+}
+
+func (b *fakeBackend) SnapshotAll() (map[int]Usage, error) {
+	b.snapshots++
+	usages := make(map[int]Usage, len(b.usages))
+	for pid, u := range b.usages {
+		if _, ok := b.errs[pid]; !ok {
+			usages[pid] = u
+		}
+	}
+	return usages, nil
+}
+
+func (b *fakeBackend) Close() error {
+	b.closes++
+	return nil
+}
+
+// fakeSampler returns a sampler of the fake backend and its clock, which
+// only moves when the test advances it.
+func fakeSampler(t *testing.T, minInterval time.Duration) (*Sampler, *fakeBackend, *time.Time) {
+	s, err := NewSampler(&Options{Backend: "fake", ImageName: "gnatsd", MemTotal: 1 << 30, MinInterval: minInterval})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	now := time.Unix(1460907480, 0)
+	s.now = func() time.Time { return now }
+	return s, s.backend.(*fakeBackend), &now
+}
+
+func fakeUsage(pid int, cpu float64) Usage {
+	return Usage{
+		PID:    pid,
+		CPU:    cpu,
+		Memory: Memory{WorkingSet: 1 << 20, Virtual: 1 << 24},
+		Valid:  MetricCPU | MetricWorkingSet | MetricVirtual,
+	}
+}
+
+func TestSamplerCache(t *testing.T) {
+	tests := []struct {
+		name        string
+		minInterval time.Duration
+		advance     time.Duration
+		calls       int // backend calls of the second sample
+	}{
+		{"default interval", 0, DefaultMinInterval - time.Millisecond, 1},
+		{"expired", 0, DefaultMinInterval, 2},
+		{"interval", time.Minute, 30 * time.Second, 1},
+		{"negative interval", -1, 0, 2},
+	}
+	for _, tt := range tests {
+		s, b, now := fakeSampler(t, tt.minInterval)
+		b.usages[10] = fakeUsage(10, 1)
+		if _, err := s.UsageForPID(10); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if _, err := s.SnapshotAll(); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+
+		b.usages[10] = fakeUsage(10, 2)
+		*now = now.Add(tt.advance)
+		u, err := s.UsageForPID(10)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		all, err := s.SnapshotAll()
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if b.calls[10] != tt.calls || b.snapshots != tt.calls {
+			t.Errorf("%s: %d usage and %d snapshot calls, want %d", tt.name, b.calls[10], b.snapshots, tt.calls)
+		}
+		if want := float64(tt.calls); u.CPU != want || all[10].CPU != want {
+			t.Errorf("%s: got cpu %v and %v, want %v", tt.name, u.CPU, all[10].CPU, want)
+		}
+	}
+}
+
+func TestSamplerUsage(t *testing.T) {
+	s, b, _ := fakeSampler(t, -1)
+	b.usages[10] = fakeUsage(10, 1)
+
+	u, err := s.UsageForPID(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.RSS != 1<<20 || u.VSS != 1<<24 || !u.Valid.Has(MetricRSS|MetricVSS) {
+		t.Errorf("memory not mapped: %+v", u)
+	}
+	if u.MemPercent != 100.0/1024 || !u.Valid.Has(MetricMemPercent) {
+		t.Errorf("got MemPercent %v, want %v", u.MemPercent, 100.0/1024)
+	}
+
+	// the snapshot is a copy
+	all, err := s.SnapshotAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if all[10].RSS != 1<<20 {
+		t.Errorf("memory not mapped: %+v", all[10])
+	}
+	delete(all, 10)
+	s.opts.MinInterval = time.Hour
+	if all, _ := s.SnapshotAll(); len(all) != 1 {
+		t.Errorf("cached snapshot changed by the caller: %v", all)
+	}
+}
+
+func TestSamplerError(t *testing.T) {
+	errBackend := errors.New("backend failure")
+	s, b, _ := fakeSampler(t, time.Minute)
+	b.usages[10] = fakeUsage(10, 1)
+	b.errs[10] = errBackend
+
+	for i := 0; i < 2; i++ {
+		u, err := s.UsageForPID(10)
+		if err != errBackend {
+			t.Fatalf("got %v, want %v", err, errBackend)
+		}
+		if u.CPU != 0 || u.Valid != 0 {
+			t.Errorf("usage is not zero on error: %+v", u)
+		}
+	}
+	// errors are cached along with usages
+	if b.calls[10] != 1 {
+		t.Errorf("got %d backend calls, want 1", b.calls[10])
+	}
+}
+
+func TestSamplerNotFound(t *testing.T) {
+	s, b, _ := fakeSampler(t, time.Minute)
+	for i := 0; i < 2; i++ {
+		if _, err := s.UsageForPID(10); err != ErrNotFound {
+			t.Fatalf("got %v, want ErrNotFound", err)
+		}
+	}
+	// a process that is gone is asked for again
+	if b.calls[10] != 2 {
+		t.Errorf("got %d backend calls, want 2", b.calls[10])
+	}
+	if len(s.samples) != 0 {
+		t.Errorf("ErrNotFound cached: %v", s.samples)
+	}
+}
+
+func TestSamplerPrune(t *testing.T) {
+	s, b, now := fakeSampler(t, time.Minute)
+	for pid := 1; pid <= 3; pid++ {
+		b.usages[pid] = fakeUsage(pid, 1)
+	}
+	s.UsageForPID(1)
+	*now = now.Add(30 * time.Second)
+	s.UsageForPID(2)
+	*now = now.Add(30 * time.Second)
+	s.UsageForPID(3)
+
+	// the sample of 1 expired, that of 2 did not
+	if len(s.samples) != 2 || s.samples[1] != nil {
+		t.Errorf("got cached pids %v, want 2 and 3", s.samples)
+	}
+}
+
+func TestSamplerClosed(t *testing.T) {
+	s, b, _ := fakeSampler(t, -1)
+	b.usages[10] = fakeUsage(10, 1)
+	for i := 0; i < 2; i++ {
+		if err := s.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if b.closes != 1 {
+		t.Errorf("backend closed %d times, want once", b.closes)
+	}
+	if _, err := s.UsageForPID(10); err != ErrClosed {
+		t.Errorf("UsageForPID: got %v, want ErrClosed", err)
+	}
+	if _, err := s.SnapshotAll(); err != ErrClosed {
+		t.Errorf("SnapshotAll: got %v, want ErrClosed", err)
+	}
+	if _, err := s.UsageForSystem(); err != ErrClosed {
+		t.Errorf("UsageForSystem: got %v, want ErrClosed", err)
+	}
+	if len(b.calls) != 0 {
+		t.Errorf("backend called after Close: %v", b.calls)
+	}
+}
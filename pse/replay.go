@@ -0,0 +1,103 @@
+package pse
+
+import (
+	"errors"
+	"io"
+	"os"
+)
+
+func init() {
+	Register("replay", openReplayBackend)
+}
+
+// Replay reads the process usage samples of a recorded typeperf or relog
+// CSV log, such as written by typeperf -o, joining the counters of each
+// process instance as live sampling does.
+type Replay struct {
+	opts *Options
+	r    *typeperfReader
+	cpu  *counterCPU
+}
+
+// NewReplay returns a replay of the log read from r.  Only the processes
+// matching the image name of the options are reported, and the log is
+// read with their typeperf locale and counters.  If opts is nil, every
+// process is reported.  Logs only hold cpu percentages, so the
+// CPUSecondsTotal mode is not supported.
+func NewReplay(r io.Reader, opts *Options) (*Replay, error) {
+	if opts == nil {
+		opts = &Options{Wildcard: true}
+	}
+	if opts.CPUMode == CPUSecondsTotal {
+		return nil, ErrCPUModeUnsupported
+	}
+	return &Replay{
+		opts: opts,
+		r:    newTypeperfReader(r, opts.TypeperfLocale),
+		cpu:  newCounterCPU(opts),
+	}, nil
+}
+
+// Next returns the usage of every process of the next sample of the log,
+// by pid, timestamped with the time of the sample.  The cpu is reported in
+// the cpu mode of the options.  It returns io.EOF at the end of the log.
+func (rp *Replay) Next() (map[int]Usage, error) {
+	rec, err := rp.r.Read()
+	if err != nil {
+		return nil, err
+	}
+	usages := usagesFromRecord(rec, rp.opts)
+	rp.cpu.convertAll(usages)
+	for pid, u := range usages {
+		rp.opts.mapMemory(&u)
+		usages[pid] = u
+	}
+	return usages, nil
+}
+
+// replayBackend replays the log of the options, each call returning the
+// next sample of the log.
+type replayBackend struct {
+	f      *os.File
+	replay *Replay
+}
+
+func openReplayBackend(opts *Options) (Backend, error) {
+	if opts.ReplayFile == "" {
+		return nil, errors.New("pse: replay backend requires a replay file")
+	}
+	f, err := os.Open(opts.ReplayFile)
+	if err != nil {
+		return nil, err
+	}
+	replay, err := NewReplay(f, opts)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &replayBackend{f: f, replay: replay}, nil
+}
+
+// UsageForPID implements Backend, returning the usage of the process in
+// the next sample.
+func (b *replayBackend) UsageForPID(pid int) (Usage, error) {
+	usages, err := b.replay.Next()
+	if err != nil {
+		return Usage{}, err
+	}
+	u, ok := usages[pid]
+	if !ok {
+		return Usage{}, ErrNotFound
+	}
+	return u, nil
+}
+
+// SnapshotAll implements Backend, returning the usages of the next sample.
+func (b *replayBackend) SnapshotAll() (map[int]Usage, error) {
+	return b.replay.Next()
+}
+
+// Close implements Backend, closing the log.
+func (b *replayBackend) Close() error {
+	return b.f.Close()
+}
@@ -0,0 +1,52 @@
+package pse
+
+import (
+	"errors"
+	"io"
+	"os"
+	"testing"
+)
+
+func TestReplay(t *testing.T) {
+	f, err := os.Open("testdata/typeperf_en-US.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	rp, err := NewReplay(f, &Options{ImageName: "gnatsd", CPUMode: CPUMachine, LogicalCPUs: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, err := rp.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(first) != 2 {
+		t.Fatalf("got %d processes, want 2", len(first))
+	}
+	if u := first[5123]; u.CPU != 1.5625/4 || u.RSS != 12767232 || u.Time.Second() != 0 {
+		t.Errorf("pid 5123: %+v", u)
+	}
+	if u := first[6042]; u.Valid.Has(MetricCPU) || !u.Valid.Has(MetricRSS) {
+		t.Errorf("pid 6042: blank cpu should be invalid, %+v", u)
+	}
+
+	second, err := rp.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u := second[5123]; u.CPU != 3.125/4 || u.Time.Second() != 1 || u.Collected.IsZero() {
+		t.Errorf("pid 5123: %+v", u)
+	}
+	if _, err := rp.Next(); err != io.EOF {
+		t.Errorf("got %v at the end of the log, want io.EOF", err)
+	}
+}
+
+func TestReplaySecondsTotal(t *testing.T) {
+	_, err := NewReplay(nil, &Options{CPUMode: CPUSecondsTotal})
+	if !errors.Is(err, ErrCPUModeUnsupported) {
+		t.Errorf("got %v, want ErrCPUModeUnsupported", err)
+	}
+}
@@ -0,0 +1,110 @@
+package pse
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os/exec"
+)
+
+// Runner runs the command line utilities of the shell backends, such as
+// typeperf.  Tests and alternate tools may substitute their own, returning
+// canned output.
+type Runner interface {
+	// Run runs the named command to completion.  A command that ran and
+	// failed is not an error, its exit code is set in the result.
+	Run(name string, args ...string) (*RunResult, error)
+
+	// Start starts the named command, for the commands whose output is
+	// read as it is written, such as a typeperf stream.
+	Start(name string, args ...string) (Process, error)
+}
+
+// RunResult is the outcome of a command run by a Runner.
+type RunResult struct {
+	Stdout   []byte
+	Stderr   []byte
+	ExitCode int
+}
+
+// Process is a command started by a Runner.
+type Process interface {
+	// Stdout returns the output of the command.  Closing it before the
+	// end of the output has the command fail writing to it.
+	Stdout() io.ReadCloser
+
+	// Kill stops the command.
+	Kill() error
+
+	// Wait waits for the command to exit, once its output has been read.
+	// As for Run, a command that ran and failed is not an error, and the
+	// result has no Stdout.
+	Wait() (*RunResult, error)
+}
+
+// execRunner runs commands with os/exec.
+type execRunner struct{}
+
+// Run implements Runner.
+func (execRunner) Run(name string, args ...string) (*RunResult, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(name, args...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	res, err := execResult(cmd, cmd.Run(), &stderr)
+	if err != nil {
+		return nil, err
+	}
+	res.Stdout = stdout.Bytes()
+	return res, nil
+}
+
+// Start implements Runner.
+func (execRunner) Start(name string, args ...string) (Process, error) {
+	p := &execProcess{cmd: exec.Command(name, args...)}
+	p.cmd.Stderr = &p.stderr
+	stdout, err := p.cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.cmd.Start(); err != nil {
+		return nil, err
+	}
+	p.stdout = stdout
+	return p, nil
+}
+
+// execResult returns the result of a command that ran, or the error that
+// kept it from running.
+func execResult(cmd *exec.Cmd, err error, stderr *bytes.Buffer) (*RunResult, error) {
+	var exitErr *exec.ExitError
+	if err != nil && !errors.As(err, &exitErr) {
+		return nil, err
+	}
+	return &RunResult{
+		Stderr:   stderr.Bytes(),
+		ExitCode: cmd.ProcessState.ExitCode(),
+	}, nil
+}
+
+// execProcess is a command started with os/exec.
+type execProcess struct {
+	cmd    *exec.Cmd
+	stdout io.ReadCloser
+	stderr bytes.Buffer
+}
+
+// Stdout implements Process.
+func (p *execProcess) Stdout() io.ReadCloser {
+	return p.stdout
+}
+
+// Kill implements Process.
+func (p *execProcess) Kill() error {
+	return p.cmd.Process.Kill()
+}
+
+// Wait implements Process.
+func (p *execProcess) Wait() (*RunResult, error) {
+	return execResult(p.cmd, p.cmd.Wait(), &p.stderr)
+}
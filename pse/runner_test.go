@@ -0,0 +1,44 @@
+package pse
+
+import (
+	"io"
+	"os/exec"
+	"testing"
+)
+
+func TestExecRunner(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("no shell to run commands")
+	}
+	script := "echo out; echo err >&2; exit 3"
+
+	res, err := execRunner{}.Run("sh", "-c", script)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(res.Stdout) != "out\n" || string(res.Stderr) != "err\n" || res.ExitCode != 3 {
+		t.Errorf("Run: got %q, %q, exit code %d", res.Stdout, res.Stderr, res.ExitCode)
+	}
+
+	p, err := execRunner{}.Start("sh", "-c", script)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := io.ReadAll(p.Stdout())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res, err = p.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != "out\n" || string(res.Stderr) != "err\n" || res.ExitCode != 3 {
+		t.Errorf("Start: got %q, %q, exit code %d", out, res.Stderr, res.ExitCode)
+	}
+
+	if _, err := (execRunner{}).Run("pse-no-such-command"); err == nil {
+		t.Error("Run of a missing command: no error")
+	}
+	if _, err := (execRunner{}).Start("pse-no-such-command"); err == nil {
+		t.Error("Start of a missing command: no error")
+	}
+}
@@ -0,0 +1,79 @@
+package pse
+
+import "time"
+
+// SystemUsage is a usage sample of the whole machine.
+type SystemUsage struct {
+	// CPU is the percent cpu of the machine since the previous sample,
+	// from 0 to 100 whatever the number of logical cpus, with its user
+	// and kernel mode parts.  It is only valid from the second sample, as
+	// reported by Valid.
+	CPU       float64
+	UserCPU   float64
+	KernelCPU float64
+
+	MemTotal     int64 // physical memory, in bytes
+	MemAvailable int64 // physical memory available without swapping
+
+	// CommitCharge is the virtual memory committed by every process, and
+	// CommitLimit the most that can be committed, in bytes.
+	CommitCharge int64
+	CommitLimit  int64
+
+	// Time is the time of the sample.
+	Time time.Time
+
+	// Valid holds MetricCPU when the cpu is set.
+	Valid Metrics
+}
+
+// systemMemory is the memory of the machine, in bytes.
+type systemMemory struct {
+	total, available          int64
+	commitCharge, commitLimit int64
+}
+
+// UsageForSystem returns the usage of the machine.  The cpu is measured
+// since the previous call.
+func (s *Sampler) UsageForSystem() (SystemUsage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return SystemUsage{}, ErrClosed
+	}
+
+	sys, err := readSystemCPUTimes()
+	if err != nil {
+		return SystemUsage{}, err
+	}
+	mem, err := readSystemMemory()
+	if err != nil {
+		return SystemUsage{}, err
+	}
+	su := SystemUsage{
+		MemTotal:     mem.total,
+		MemAvailable: mem.available,
+		CommitCharge: mem.commitCharge,
+		CommitLimit:  mem.commitLimit,
+		Time:         time.Now(),
+	}
+	if prev := s.sysCPU; prev != nil {
+		total := sys.Total() - prev.Total()
+		su.CPU = percentOf(sys.Busy()-prev.Busy(), total)
+		su.UserCPU = percentOf(sys.User-prev.User, total)
+		su.KernelCPU = percentOf(sys.Kernel-prev.Kernel, total)
+		su.Valid = MetricCPU
+	}
+	s.sysCPU = &sys
+	return su, nil
+}
+
+// setMemPercent sets the resident set size of a usage as a percentage of
+// the physical memory, when both are known.
+func (s *Sampler) setMemPercent(u *Usage) {
+	if s.memTotal > 0 && u.Valid.Has(MetricRSS) {
+		u.MemPercent = 100.0 * float64(u.RSS) / float64(s.memTotal)
+		u.Valid |= MetricMemPercent
+	}
+}
@@ -0,0 +1,73 @@
+package pse
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"runtime"
+	"strconv"
+)
+
+// logicalCPUs returns the number of online cpus, whose times are summed in
+// the cpu line of /proc/stat.  runtime.NumCPU only counts those of the
+// affinity mask of the process.
+func logicalCPUs() int {
+	data, err := os.ReadFile("/proc/stat")
+	if err != nil {
+		return runtime.NumCPU()
+	}
+	if n := countStatCPUs(data); n > 0 {
+		return n
+	}
+	return runtime.NumCPU()
+}
+
+// countStatCPUs counts the cpu<n> lines of /proc/stat.
+func countStatCPUs(data []byte) int {
+	n := 0
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		if len(line) > 3 && bytes.HasPrefix(line, []byte("cpu")) && line[3] >= '0' && line[3] <= '9' {
+			n++
+		}
+	}
+	return n
+}
+
+// readSystemMemory reads the memory of the system from /proc/meminfo.
+func readSystemMemory() (systemMemory, error) {
+	data, err := os.ReadFile("/proc/meminfo")
+	if err != nil {
+		return systemMemory{}, err
+	}
+	return parseMeminfo(data)
+}
+
+// parseMeminfo parses /proc/meminfo, whose sizes are in kB.
+func parseMeminfo(data []byte) (systemMemory, error) {
+	info := make(map[string]int64)
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		fields := bytes.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		v, err := strconv.ParseInt(string(fields[1]), 10, 64)
+		if err != nil {
+			return systemMemory{}, fmt.Errorf("unable to parse /proc/meminfo: %v", err)
+		}
+		info[string(bytes.TrimSuffix(fields[0], []byte(":")))] = v * 1024
+	}
+	mem := systemMemory{
+		total:        info["MemTotal"],
+		commitCharge: info["Committed_AS"],
+		commitLimit:  info["CommitLimit"],
+	}
+	// MemAvailable is estimated by kernels older than 3.14
+	var ok bool
+	if mem.available, ok = info["MemAvailable"]; !ok {
+		mem.available = info["MemFree"] + info["Buffers"] + info["Cached"]
+	}
+	if mem.total == 0 {
+		return systemMemory{}, fmt.Errorf("unexpected /proc/meminfo format")
+	}
+	return mem, nil
+}
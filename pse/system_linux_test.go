@@ -0,0 +1,64 @@
+package pse
+
+import (
+	"os"
+	"runtime"
+	"testing"
+)
+
+func TestCountStatCPUs(t *testing.T) {
+	stat := "cpu  4705 356 584 3699 23 23 0 0 0 0\n" +
+		"cpu0 1393 280 234 852 3 8 0 0 0 0\n" +
+		"cpu1 1172 36 112 940 6 5 0 0 0 0\n" +
+		"cpu3 1066 24 120 947 7 5 0 0 0 0\n" +
+		"intr 114930548 113199788 3 0 5 263 0 4 [... lots more numbers ...]\n" +
+		"ctxt 1990473\n" +
+		"btime 1062191376\n" +
+		"processes 2915\n" +
+		"procs_running 1\n"
+	if n := countStatCPUs([]byte(stat)); n != 3 {
+		t.Errorf("got %d cpus, want 3", n)
+	}
+	if n := logicalCPUs(); n < runtime.NumCPU() {
+		t.Errorf("got %d logical cpus, fewer than the %d usable", n, runtime.NumCPU())
+	}
+}
+
+func TestParseMeminfo(t *testing.T) {
+	data, err := os.ReadFile("testdata/proc_meminfo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := parseMeminfo(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := systemMemory{
+		total:        6147400 << 10,
+		available:    5637376 << 10,
+		commitCharge: 341300 << 10,
+		commitLimit:  3073700 << 10,
+	}
+	if got != want {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	// without MemAvailable, the free, buffers and cache memory is available
+	old := "MemTotal:        6147400 kB\n" +
+		"MemFree:         4450312 kB\n" +
+		"Buffers:           64552 kB\n" +
+		"Cached:          1311932 kB\n"
+	got, err = parseMeminfo([]byte(old))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := int64(4450312+64552+1311932) << 10; got.available != want {
+		t.Errorf("got available %d, want %d", got.available, want)
+	}
+
+	for _, data := range []string{"", "MemFree: 4450312 kB\n", "MemTotal: lots kB\n"} {
+		if _, err := parseMeminfo([]byte(data)); err == nil {
+			t.Errorf("%q: no error", data)
+		}
+	}
+}
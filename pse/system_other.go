@@ -0,0 +1,25 @@
+//go:build !linux && !windows
+// +build !linux,!windows
+
+package pse
+
+import (
+	"errors"
+	"runtime"
+)
+
+// errNoSystemUsage is returned by UsageForSystem on platforms it does not
+// support.
+var errNoSystemUsage = errors.New("pse: system usage not supported on this platform")
+
+func readSystemCPUTimes() (CPUTimes, error) {
+	return CPUTimes{}, errNoSystemUsage
+}
+
+func readSystemMemory() (systemMemory, error) {
+	return systemMemory{}, errNoSystemUsage
+}
+
+func logicalCPUs() int {
+	return runtime.NumCPU()
+}
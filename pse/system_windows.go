@@ -0,0 +1,61 @@
+package pse
+
+import (
+	"runtime"
+	"syscall"
+	"unsafe"
+)
+
+var (
+	procGlobalMemoryStatusEx    = modkernel32.NewProc("GlobalMemoryStatusEx")
+	procGetActiveProcessorCount = modkernel32.NewProc("GetActiveProcessorCount")
+)
+
+// allProcessorGroups has GetActiveProcessorCount count the processors of
+// every group.
+const allProcessorGroups = 0xFFFF
+
+// logicalCPUs returns the number of active logical processors, of every
+// processor group.  runtime.NumCPU only counts those of the affinity mask
+// of the process.
+func logicalCPUs() int {
+	if procGetActiveProcessorCount.Find() == nil {
+		if n, _, _ := procGetActiveProcessorCount.Call(allProcessorGroups); n > 0 {
+			return int(n)
+		}
+	}
+	return runtime.NumCPU()
+}
+
+// memoryStatusEx is the MEMORYSTATUSEX structure of GlobalMemoryStatusEx.
+type memoryStatusEx struct {
+	Length               uint32
+	MemoryLoad           uint32
+	TotalPhys            uint64
+	AvailPhys            uint64
+	TotalPageFile        uint64
+	AvailPageFile        uint64
+	TotalVirtual         uint64
+	AvailVirtual         uint64
+	AvailExtendedVirtual uint64
+}
+
+// readSystemMemory reads the memory status of the machine.  The page
+// file sizes are those of the commit limit, not of the page file alone.
+func readSystemMemory() (systemMemory, error) {
+	var ms memoryStatusEx
+	ms.Length = uint32(unsafe.Sizeof(ms))
+	r1, _, e1 := procGlobalMemoryStatusEx.Call(uintptr(unsafe.Pointer(&ms)))
+	if r1 == 0 {
+		if e1 != nil {
+			return systemMemory{}, e1
+		}
+		return systemMemory{}, syscall.EINVAL
+	}
+	return systemMemory{
+		total:        int64(ms.TotalPhys),
+		available:    int64(ms.AvailPhys),
+		commitCharge: int64(ms.TotalPageFile - ms.AvailPageFile),
+		commitLimit:  int64(ms.TotalPageFile),
+	}, nil
+}
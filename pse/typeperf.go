@@ -0,0 +1,248 @@
+package pse
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+func init() {
+	Register("typeperf", openTypeperfBackend)
+}
+
+// typeperfBackend retrieves process usage by running the typeperf
+// command line utility.
+type typeperfBackend struct {
+	opts *Options
+
+	// cache the instance names by pid for future calls.
+	imageNames map[int]string
+
+	cpu *counterCPU
+}
+
+func openTypeperfBackend(opts *Options) (Backend, error) {
+	// typeperf only formats the cpu counters as percentages
+	if opts.CPUMode == CPUSecondsTotal {
+		return nil, ErrCPUModeUnsupported
+	}
+	if opts.StreamInterval > 0 {
+		return openTypeperfStreamBackend(opts)
+	}
+	return &typeperfBackend{
+		opts:       opts,
+		imageNames: make(map[int]string),
+		cpu:        newCounterCPU(opts),
+	}, nil
+}
+
+// processCounters are the performance counters of a process instance
+// queried by the typeperf backend.
+type processCounters struct {
+	pid string
+
+	// set are the paths of the counters of processCounterSet.
+	set [len(processCounterSet)]string
+
+	// extra are the additional counters of the options, by metric name.
+	extra []TypeperfCounter
+}
+
+func newProcessCounters(instName string, extra []TypeperfCounter) *processCounters {
+	c := &processCounters{pid: processCounterPath(instName, "ID Process")}
+	for i, pc := range processCounterSet {
+		c.set[i] = processCounterPath(instName, pc.name)
+	}
+	for _, e := range extra {
+		c.extra = append(c.extra, TypeperfCounter{
+			Metric:  e.Metric,
+			Counter: processCounterPath(instName, e.Counter),
+		})
+	}
+	return c
+}
+
+// paths returns the paths of every counter.
+func (c *processCounters) paths() []string {
+	paths := append([]string{c.pid}, c.set[:]...)
+	for _, e := range c.extra {
+		paths = append(paths, e.Counter)
+	}
+	return paths
+}
+
+// usage extracts the usage of the process from a record.  The pid is set
+// to -1 if the record has no value for the process id.  Other counters
+// without a value are reported as missing metrics.
+func (c *processCounters) usage(rec *TypeperfRecord, pid *int, u *Usage) {
+	u.Time = rec.Time
+	u.Collected = rec.Collected
+	if u.Time.IsZero() {
+		u.Time = rec.Collected
+	}
+	*pid = -1
+	if v, ok := rec.Value(c.pid); ok {
+		*pid = int(v)
+	}
+	for i, pc := range processCounterSet {
+		if v, ok := rec.Value(c.set[i]); ok {
+			pc.set(u, v)
+			u.Valid |= pc.metric
+		}
+	}
+	for _, e := range c.extra {
+		if v, ok := rec.Value(e.Counter); ok {
+			if u.Counters == nil {
+				u.Counters = make(map[string]float64, len(c.extra))
+			}
+			u.Counters[e.Metric] = v
+		}
+	}
+}
+
+// errNoValidData is returned when typeperf finds none of the counters, as
+// when no instance of the image is running.
+var errNoValidData = errors.New("typeperf: no valid counter data")
+
+// runTypeperf returns a single sample of the given English counters.
+func (b *typeperfBackend) runTypeperf(counters ...string) (*TypeperfRecord, error) {
+	locale := b.opts.TypeperfLocale
+	if locale == nil {
+		locale = defaultTypeperfLocale
+	}
+	runner := b.opts.Runner
+	if runner == nil {
+		runner = execRunner{}
+	}
+
+	// query the counters using typeper, in the language of the system.
+	// "-sc","1" indicates to return one set of data (rather than
+	// continuous monitoring)
+	args, counterFile, err := typeperfCounterArgs(locale, counters)
+	if err != nil {
+		return nil, err
+	}
+	if counterFile != "" {
+		defer os.Remove(counterFile)
+	}
+	res, err := runner.Run("typeperf", append(args, "-sc", "1")...)
+	if err != nil {
+		// something wrong issuing the command
+		return nil, fmt.Errorf("typeperf failed: %v", err)
+	}
+	if res.ExitCode != 0 {
+		return nil, typeperfExitError(res)
+	}
+
+	rec, err := newTypeperfReader(bytes.NewReader(res.Stdout), locale).Read()
+	if err == io.EOF {
+		return nil, errors.New("invalid result")
+	}
+	return rec, err
+}
+
+// typeperfExitError returns the error of a typeperf run that failed.
+// typeperf exits with the PDH status of the failure, which does not depend
+// on the language of the system, unlike its messages.
+func typeperfExitError(res *RunResult) error {
+	code := uint32(res.ExitCode)
+	switch {
+	case code == PDH_INVALID_DATA || code == PDH_CSTATUS_NO_INSTANCE:
+		return errNoValidData
+	case strings.Contains(string(res.Stdout), "The data is not valid"):
+		return errNoValidData
+	}
+	if _, ok := pdhMessages[code]; ok {
+		return &PdhError{Op: "typeperf", Code: code}
+	}
+	return fmt.Errorf("typeperf failed: exit status %d", res.ExitCode)
+}
+
+// getStatsForProcess retrieves information for a given instance name.
+// The native command line utility to get pcpu, rss, and vsz equivalents
+// is the typeperf facility, which queries performance counter values.
+// Notably, typeperf cannot search using a pid, but instead uses a volatile
+// process image name.  If there is more than one instance, #<instancecount> is
+// appended to the image name. An alternative is to map the Pdh* native windows
+// API from kernel32.dll, etc. and call those APIs directly, but this is the
+// simplest approach.
+func (b *typeperfBackend) getStatsForProcess(instName string, u *Usage, pid *int) (err error) {
+
+	// setup the performance counters to query by our instance name
+	c := newProcessCounters(instName, b.opts.TypeperfCounters)
+
+	rec, err := b.runTypeperf(c.paths()...)
+	if err == errNoValidData {
+		// Signal that the command ran, but the image instance was not
+		// found through a PID of -1.
+		*pid = -1
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	c.usage(rec, pid, u)
+
+	return nil
+}
+
+// UsageForPID implements Backend.  Instances are matched against the pid
+// through their ID Process counter.
+func (b *typeperfBackend) UsageForPID(pid int) (Usage, error) {
+	var ppid int = -1
+	u := Usage{PID: pid}
+
+	// if we have cached the image name try that first
+	if name, ok := b.imageNames[pid]; ok {
+		err := b.getStatsForProcess(name, &u, &ppid)
+		if err != nil {
+			return Usage{}, err
+		}
+		// If the instance name's pid matches, we're done.
+		// Otherwise, this instance has been renamed, which is possible
+		// as other instances of the image start and stop on the system.
+		if ppid == pid {
+			b.cpu.convert(&u)
+			return u, nil
+		}
+	}
+	// If we get here, the instance name is invalid (nil, or out of sync).
+	// Query every instance at once, which finds the current names along
+	// with their counters, so that the process cannot be renamed between
+	// finding its name and querying its counters.
+	usages, err := b.SnapshotAll()
+	if err != nil {
+		return Usage{}, err
+	}
+	u, ok := usages[pid]
+	if !ok {
+		return Usage{}, ErrNotFound
+	}
+	return u, nil
+}
+
+// SnapshotAll implements Backend, querying the counters of every instance
+// of the image at once.
+func (b *typeperfBackend) SnapshotAll() (map[int]Usage, error) {
+	c := newProcessCounters(b.opts.ImageName+"*", b.opts.TypeperfCounters)
+	rec, err := b.runTypeperf(c.paths()...)
+	if err == errNoValidData {
+		b.imageNames = make(map[int]string)
+		return map[int]Usage{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	b.imageNames = instancesFromRecord(rec, b.opts)
+	usages := usagesFromRecord(rec, b.opts)
+	b.cpu.convertAll(usages)
+	return usages, nil
+}
+
+// Close implements Backend.
+func (b *typeperfBackend) Close() error {
+	return nil
+}
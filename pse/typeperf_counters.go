@@ -0,0 +1,74 @@
+package pse
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"os"
+	"unicode/utf16"
+)
+
+// TypeperfCounter is an additional counter of the Process object sampled
+// by the typeperf backend, reported under a metric name in the Counters of
+// the usage.
+type TypeperfCounter struct {
+	Metric  string // metric name, eg: "handles"
+	Counter string // English counter name, eg: "Handle Count"
+}
+
+// writeCounterFile writes counter paths one per line, as read by the -cf
+// option of typeperf.  The file is UTF-16 with a byte order mark: without
+// one typeperf reads it in the ANSI code page, which garbles localized
+// counter names such as "Octets privés".
+func writeCounterFile(w io.Writer, counters []string) error {
+	bw := bufio.NewWriter(w)
+	units := []uint16{0xFEFF}
+	for _, c := range counters {
+		units = append(units, utf16.Encode([]rune(c+"\r\n"))...)
+	}
+	if err := binary.Write(bw, binary.LittleEndian, units); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// createCounterFile writes counter paths to a new temporary counter file,
+// and returns its name.  The caller removes it once typeperf has exited.
+func createCounterFile(counters []string) (string, error) {
+	f, err := os.CreateTemp("", "pse-counters-*.txt")
+	if err != nil {
+		return "", err
+	}
+	err = writeCounterFile(f, counters)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// maxArgCounters is the number of counters passed to typeperf on the
+// command line, those of the default set.  More are written to a counter
+// file, as the length of the command line is limited.
+const maxArgCounters = 1 + len(processCounterSet)
+
+// typeperfCounterArgs returns the typeperf arguments naming the English
+// counters, translated with the locale.  If a counter file is written, its
+// name is returned for the caller to remove.
+func typeperfCounterArgs(locale *TypeperfLocale, counters []string) (args []string, counterFile string, err error) {
+	paths := make([]string, len(counters))
+	for i, c := range counters {
+		paths[i] = locale.LocalPath(c)
+	}
+	if len(paths) <= maxArgCounters {
+		return paths, "", nil
+	}
+	counterFile, err = createCounterFile(paths)
+	if err != nil {
+		return nil, "", err
+	}
+	return []string{"-cf", counterFile}, counterFile, nil
+}
@@ -0,0 +1,245 @@
+package pse
+
+import (
+	"bufio"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// typeperf writes its samples as CSV, after a header row naming the
+// counter of each column:
+//
+//	"(PDH-CSV 4.0)","\\HOST\Process(gnatsd)\ID Process","\\HOST\Process(gnatsd)\% Processor Time"
+//	"04/17/2016 15:38:00.016","5123.000000","1.234000"
+//
+// A value is blank when the counter has no valid data.  On localized
+// systems the counter names are translated, and the separators and the
+// date follow the regional settings, as described by a TypeperfLocale.
+// Status messages such as "Exiting, please wait..." may follow the
+// samples.  The first column of the header may name the time zone of the
+// recorder and its bias, the minutes to add to its local time to get UTC:
+//
+//	"(PDH-CSV 4.0) (Mitteleuropäische Sommerzeit)(-120)"
+
+// typeperfHeaderPrefix starts the first column of the header row.
+const typeperfHeaderPrefix = "(PDH-CSV"
+
+// errNoHeader is returned when typeperf output has no header row.
+var errNoHeader = errors.New("typeperf output has no header")
+
+// TypeperfRecord is a sample read from typeperf output.
+type TypeperfRecord struct {
+	// Time is the time of the sample, from the timestamp column.  It is
+	// zero if the timestamp cannot be parsed with the reader locale.
+	Time time.Time
+
+	// RawTime is the timestamp column, as written by typeperf.
+	RawTime string
+
+	// Collected is the local time the record was read, which follows
+	// Time by the delay in getting the sample.
+	Collected time.Time
+
+	// values holds the valid values by counter key.
+	values map[string]float64
+}
+
+// Value returns the value of a counter, and false if the record has no
+// valid value for it.  The machine prefix and the case of the counter path
+// are ignored.
+func (rec *TypeperfRecord) Value(counter string) (float64, bool) {
+	v, ok := rec.values[counterKey(counter)]
+	return v, ok
+}
+
+// Counters returns the normalized paths of the counters with a valid
+// value in the record, in no particular order.
+func (rec *TypeperfRecord) Counters() []string {
+	counters := make([]string, 0, len(rec.values))
+	for c := range rec.values {
+		counters = append(counters, c)
+	}
+	return counters
+}
+
+// counterKey normalizes a counter path for lookups: the \\machine prefix
+// that typeperf adds to the header is removed, case is ignored as it is by
+// perfmon, and the first instance of an image, which can be named both
+// <image> and <image>#0, is named <image>.
+func counterKey(path string) string {
+	p, err := ParseCounterPath(path)
+	if err != nil {
+		return strings.ToLower(path)
+	}
+	p.Machine = ""
+	if p.Index == 0 {
+		p.HasIndex = false
+	}
+	return strings.ToLower(p.String())
+}
+
+// typeperfReader reads the records of typeperf CSV output, mapping each
+// column to its counter through the header row.
+type typeperfReader struct {
+	br     *bufio.Reader
+	r      *csv.Reader // records, once the header is read
+	locale *TypeperfLocale
+	header []string // counter keys by column
+}
+
+// newTypeperfReader returns a reader of typeperf output formatted with the
+// given locale, which may be nil for the default locale.  The counters of
+// the header are translated to English.
+func newTypeperfReader(r io.Reader, locale *TypeperfLocale) *typeperfReader {
+	if locale == nil {
+		locale = defaultTypeperfLocale
+	}
+	return &typeperfReader{br: bufio.NewReader(r), locale: locale}
+}
+
+// newCSVReader returns a reader of the records of typeperf output.
+func newCSVReader(r io.Reader, comma rune) *csv.Reader {
+	cr := csv.NewReader(r)
+	cr.Comma = comma
+	// status messages have a single field
+	cr.FieldsPerRecord = -1
+	cr.LazyQuotes = true
+	return cr
+}
+
+// readHeader reads up to and including the header row.
+func (r *typeperfReader) readHeader() error {
+	for {
+		line, err := r.br.ReadString('\n')
+		if err != nil && (err != io.EOF || line == "") {
+			if err == io.EOF {
+				return errNoHeader
+			}
+			return err
+		}
+		// logs written by typeperf -o may start with a byte order mark
+		line = strings.TrimPrefix(line, "\ufeff")
+		if !strings.HasPrefix(strings.TrimPrefix(line, `"`), typeperfHeaderPrefix) {
+			continue
+		}
+		comma := r.locale.ListSeparator
+		if comma == 0 {
+			comma = headerSeparator(line)
+		}
+		fields, err := newCSVReader(strings.NewReader(line), comma).Read()
+		if err != nil {
+			return err
+		}
+		if len(fields) < 2 {
+			return errNoHeader
+		}
+		if r.locale.Location == nil {
+			if loc := headerLocation(fields[0]); loc != nil {
+				locale := *r.locale
+				locale.Location = loc
+				r.locale = &locale
+			}
+		}
+		r.header = make([]string, len(fields))
+		for i, f := range fields[1:] {
+			r.header[i+1] = counterKey(r.locale.EnglishPath(f))
+		}
+		r.r = newCSVReader(r.br, comma)
+		return nil
+	}
+}
+
+// headerSeparator returns the list separator following the first column
+// of the header row: a comma, or the list separator of the regional
+// settings, such as a semicolon.
+func headerSeparator(line string) rune {
+	rest := line
+	if strings.HasPrefix(rest, `"`) {
+		if i := strings.IndexByte(rest[1:], '"'); i >= 0 {
+			rest = rest[i+2:]
+		}
+	} else if i := strings.IndexAny(rest, ",;\t"); i >= 0 {
+		rest = rest[i:]
+	}
+	if rest == "" || strings.ContainsAny(rest[:1], "\r\n") {
+		return ','
+	}
+	c, _ := utf8.DecodeRuneInString(rest)
+	return c
+}
+
+// headerLocation returns the time zone named in the first column of the
+// header row, fixed at its bias, or nil if there is none.
+func headerLocation(field string) *time.Location {
+	field = strings.TrimSpace(field)
+	i := strings.LastIndexByte(field, '(')
+	if i < 0 || !strings.HasSuffix(field, ")") {
+		return nil
+	}
+	bias, err := strconv.Atoi(field[i+1 : len(field)-1])
+	if err != nil {
+		return nil
+	}
+	// the name follows (PDH-CSV 4.0), and may hold parentheses
+	name := field[:i]
+	if j := strings.IndexByte(name, ')'); j >= 0 {
+		name = name[j+1:]
+	}
+	name = strings.TrimSpace(name)
+	name = strings.TrimSuffix(strings.TrimPrefix(name, "("), ")")
+	return time.FixedZone(name, -bias*60)
+}
+
+// Counters returns the counter keys of the header row, in column order.
+func (r *typeperfReader) Counters() ([]string, error) {
+	if r.header == nil {
+		if err := r.readHeader(); err != nil {
+			return nil, err
+		}
+	}
+	return r.header[1:], nil
+}
+
+// Read returns the next record, or io.EOF when there are no more.
+func (r *typeperfReader) Read() (*TypeperfRecord, error) {
+	if r.header == nil {
+		if err := r.readHeader(); err != nil {
+			return nil, err
+		}
+	}
+	for {
+		fields, err := r.r.Read()
+		if err != nil {
+			return nil, err
+		}
+		// skip status messages
+		if len(fields) != len(r.header) {
+			continue
+		}
+
+		rec := &TypeperfRecord{
+			RawTime:   fields[0],
+			Collected: time.Now(),
+			values:    make(map[string]float64, len(fields)-1),
+		}
+		rec.Time, _ = r.locale.ParseTime(fields[0])
+		for i := 1; i < len(fields); i++ {
+			value := strings.TrimSpace(fields[i])
+			if value == "" {
+				continue
+			}
+			v, err := r.locale.parseFloat(value)
+			if err != nil {
+				return nil, fmt.Errorf("unable to parse %s: %q", r.header[i], fields[i])
+			}
+			rec.values[r.header[i]] = v
+		}
+		return rec, nil
+	}
+}
@@ -0,0 +1,259 @@
+package pse
+
+import (
+	"io"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The typeperf outputs under testdata are synthetic: they were written by
+// hand after the documented typeperf output format, not captured, and are
+// saved as UTF-8 rather than in the encoding typeperf writes.  They stand
+// for the output of
+//
+//	typeperf \Process(gnatsd*)\... -sc 2
+//
+// sampling the ID Process, % Processor Time, Working Set and Virtual Bytes
+// counters of two gnatsd instances on an en-US, a de-DE and a fr-FR
+// system, the first % Processor Time of the second instance having no
+// valid data.  The de-DE output is separated by semicolons.  No fixture
+// has the dotted time format, which is covered by the ParseTime tests.
+
+// typeperfSample are the time and values of a sample of a fixture.
+type typeperfSample struct {
+	time   time.Time
+	values map[string]float64
+}
+
+// typeperfFixtures are the samples of each fixture, the times being read
+// in UTC.
+var typeperfFixtures = map[string][]typeperfSample{
+	"testdata/typeperf_en-US.csv": {
+		{
+			time: time.Date(2016, 4, 17, 15, 38, 0, 16e6, time.UTC),
+			values: map[string]float64{
+				`\Process(gnatsd)\ID Process`:            5123,
+				`\Process(gnatsd#1)\ID Process`:          6042,
+				`\Process(gnatsd)\% Processor Time`:      1.5625,
+				`\Process(gnatsd)\Working Set`:           12767232,
+				`\Process(gnatsd#1)\Working Set`:         9306112,
+				`\Process(gnatsd)\Virtual Bytes`:         4331663360,
+				`\Process(gnatsd#1)\Virtual Bytes`:       4328615936,
+				`\\BUILD01\process(GNATSD#0)\id process`: 5123,
+			},
+		},
+		{
+			time: time.Date(2016, 4, 17, 15, 38, 1, 31e6, time.UTC),
+			values: map[string]float64{
+				`\Process(gnatsd)\% Processor Time`:   3.125,
+				`\Process(gnatsd#1)\% Processor Time`: 0,
+				`\Process(gnatsd)\Working Set`:        12771328,
+			},
+		},
+	},
+	"testdata/typeperf_de-DE.csv": {
+		{
+			time: time.Date(2016, 4, 17, 23, 38, 4, 527e6, time.UTC),
+			values: map[string]float64{
+				`\Process(gnatsd)\ID Process`:       2816,
+				`\Process(gnatsd#1)\ID Process`:     3140,
+				`\Process(gnatsd)\% Processor Time`: 0.78125,
+				`\Process(gnatsd)\Working Set`:      14024704,
+				`\Process(gnatsd#1)\Virtual Bytes`:  4328615936,
+			},
+		},
+		{
+			time: time.Date(2016, 4, 17, 23, 38, 5, 541e6, time.UTC),
+			values: map[string]float64{
+				`\Process(gnatsd)\% Processor Time`:   4.6875,
+				`\Process(gnatsd#1)\% Processor Time`: 1.5625,
+				`\Process(gnatsd)\Working Set`:        14028800,
+			},
+		},
+	},
+	"testdata/typeperf_fr-FR.csv": {
+		{
+			time: time.Date(2016, 4, 18, 0, 38, 9, 102e6, time.UTC),
+			values: map[string]float64{
+				`\Process(gnatsd)\ID Process`:       7480,
+				`\Process(gnatsd#1)\ID Process`:     912,
+				`\Process(gnatsd)\% Processor Time`: 3.125,
+				`\Process(gnatsd#1)\Working Set`:    8867840,
+				`\Process(gnatsd)\Virtual Bytes`:    4330049536,
+			},
+		},
+		{
+			time: time.Date(2016, 4, 18, 0, 38, 10, 117e6, time.UTC),
+			values: map[string]float64{
+				`\Process(gnatsd)\% Processor Time`:   6.25,
+				`\Process(gnatsd#1)\% Processor Time`: 0,
+				`\Process(gnatsd)\Working Set`:        11505664,
+			},
+		},
+	},
+}
+
+// inUTC returns a copy of a locale reading times in UTC.
+func inUTC(l *TypeperfLocale) *TypeperfLocale {
+	c := *l
+	c.Location = time.UTC
+	return &c
+}
+
+func TestTypeperfReaderFixtures(t *testing.T) {
+	tests := []struct {
+		file   string
+		locale *TypeperfLocale
+	}{
+		{"testdata/typeperf_en-US.csv", inUTC(defaultTypeperfLocale)},
+		{"testdata/typeperf_de-DE.csv", inUTC(TypeperfLocaleDE)},
+		{"testdata/typeperf_fr-FR.csv", inUTC(TypeperfLocaleFR)},
+	}
+	for _, tt := range tests {
+		f, err := os.Open(tt.file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := newTypeperfReader(f, tt.locale)
+		counters, err := r.Counters()
+		if err != nil {
+			t.Fatalf("%s: %v", tt.file, err)
+		}
+		if len(counters) != 8 || counters[0] != `\process(gnatsd)\id process` {
+			t.Errorf("%s: counters %q", tt.file, counters)
+		}
+		for i, want := range typeperfFixtures[tt.file] {
+			rec, err := r.Read()
+			if err != nil {
+				t.Fatalf("%s: record %d: %v", tt.file, i, err)
+			}
+			if !rec.Time.Equal(want.time) {
+				t.Errorf("%s: record %d: time %v, want %v", tt.file, i, rec.Time, want.time)
+			}
+			if rec.Collected.IsZero() {
+				t.Errorf("%s: record %d: no collection time", tt.file, i)
+			}
+			for c, v := range want.values {
+				if got, ok := rec.Value(c); !ok || got != v {
+					t.Errorf("%s: record %d: %s = %v, %v, want %v", tt.file, i, c, got, ok, v)
+				}
+			}
+			if n := len(rec.Counters()); n != len(counters)-1+i {
+				t.Errorf("%s: record %d: %d valid counters", tt.file, i, n)
+			}
+		}
+		// status messages are skipped
+		if _, err := r.Read(); err != io.EOF {
+			t.Errorf("%s: got %v, want io.EOF", tt.file, err)
+		}
+		f.Close()
+	}
+}
+
+func TestTypeperfReaderHeader(t *testing.T) {
+	const (
+		header = `"(PDH-CSV 4.0)","\\H\Process(gnatsd)\ID Process"` + "\r\n"
+		row    = `"04/17/2016 15:38:00.016","5123.000000"` + "\r\n"
+	)
+	semicolons := strings.NewReplacer(`","`, `";"`)
+	tests := []struct {
+		name   string
+		output string
+		comma  rune // ListSeparator of the locale
+		err    error
+	}{
+		{"comma", "\r\n" + header + row + "Exiting, please wait...\r\n", 0, nil},
+		{"semicolon", semicolons.Replace(header + row), 0, nil},
+		{"bom", "\ufeff" + header + row, 0, nil},
+		{"unquoted", `(PDH-CSV 4.0);\\H\Process(gnatsd)\ID Process` + "\r\n" + semicolons.Replace(row), 0, nil},
+		{"no newline", header + strings.TrimSuffix(row, "\r\n"), 0, nil},
+		{"locale", semicolons.Replace(header + row), ';', nil},
+		{"no header", "Error: No valid counters.\r\n", 0, errNoHeader},
+		{"empty", "", 0, errNoHeader},
+	}
+	for _, tt := range tests {
+		rec, err := newTypeperfReader(strings.NewReader(tt.output), &TypeperfLocale{ListSeparator: tt.comma}).Read()
+		if err != tt.err {
+			t.Errorf("%s: got %v, want %v", tt.name, err, tt.err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if v, ok := rec.Value(`\Process(gnatsd)\ID Process`); !ok || v != 5123 {
+			t.Errorf("%s: ID Process = %v, %v", tt.name, v, ok)
+		}
+	}
+}
+
+func TestTypeperfReaderInvalidValue(t *testing.T) {
+	output := "\"(PDH-CSV 4.0)\",\"\\\\H\\Process(gnatsd)\\ID Process\"\r\n\"04/17/2016 15:38:00.016\",\"n/a\"\r\n"
+	if _, err := newTypeperfReader(strings.NewReader(output), nil).Read(); err == nil {
+		t.Fatal("expected an error")
+	}
+}
+
+func TestHeaderLocation(t *testing.T) {
+	tests := []struct {
+		field  string
+		name   string
+		offset int // seconds east of UTC
+		ok     bool
+	}{
+		{"(PDH-CSV 4.0) (Mitteleuropäische Sommerzeit)(-120)", "Mitteleuropäische Sommerzeit", 2 * 3600, true},
+		{"(PDH-CSV 4.0) (Pacific Daylight Time)(420)", "Pacific Daylight Time", -7 * 3600, true},
+		{"(PDH-CSV 4.0) (Paris, Madrid (heure d’été))(-120)", "Paris, Madrid (heure d’été)", 2 * 3600, true},
+		{"(PDH-CSV 4.0) (India Standard Time)(-330) ", "India Standard Time", 5*3600 + 1800, true},
+		{"(PDH-CSV 4.0)", "", 0, false},
+		{"(PDH-CSV 4.0) (UTC)(bias)", "", 0, false},
+	}
+	for _, tt := range tests {
+		loc := headerLocation(tt.field)
+		if (loc != nil) != tt.ok {
+			t.Errorf("%q: got %v", tt.field, loc)
+			continue
+		}
+		if loc == nil {
+			continue
+		}
+		name, offset := time.Date(2016, 4, 17, 0, 0, 0, 0, loc).Zone()
+		if name != tt.name || offset != tt.offset {
+			t.Errorf("%q: got %q %d, want %q %d", tt.field, name, offset, tt.name, tt.offset)
+		}
+	}
+}
+
+// TestTypeperfReaderLocation checks that the timestamps are read in the
+// time zone of the header, unless the locale has one.
+func TestTypeperfReaderLocation(t *testing.T) {
+	cest := time.FixedZone("", 2*3600)
+	tests := []struct {
+		file   string
+		locale *TypeperfLocale
+		want   time.Time
+	}{
+		{"testdata/typeperf_de-DE.csv", TypeperfLocaleDE, time.Date(2016, 4, 17, 23, 38, 4, 527e6, cest)},
+		{"testdata/typeperf_fr-FR.csv", TypeperfLocaleFR, time.Date(2016, 4, 18, 0, 38, 9, 102e6, cest)},
+		{"testdata/typeperf_de-DE.csv", inUTC(TypeperfLocaleDE), time.Date(2016, 4, 17, 23, 38, 4, 527e6, time.UTC)},
+		{"testdata/typeperf_en-US.csv", nil, time.Date(2016, 4, 17, 15, 38, 0, 16e6, time.Local)},
+	}
+	for _, tt := range tests {
+		f, err := os.Open(tt.file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rec, err := newTypeperfReader(f, tt.locale).Read()
+		f.Close()
+		if err != nil {
+			t.Fatalf("%s: %v", tt.file, err)
+		}
+		if !rec.Time.Equal(tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.file, rec.Time, tt.want)
+		}
+	}
+	if TypeperfLocaleDE.Location != nil {
+		t.Error("the header time zone was set on the locale")
+	}
+}
@@ -0,0 +1,198 @@
+package pse
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// DateOrder is the order of the day, month and year in a date.
+type DateOrder int
+
+// Date orders
+const (
+	MDY DateOrder = iota // 04/17/2016, the default
+	DMY                  // 17.04.2016
+	YMD                  // 2016-04-17
+)
+
+// TypeperfLocale describes the regional settings typeperf formats its
+// output with, and the language of the counter names.
+type TypeperfLocale struct {
+	// DateOrder is the order of the date in the timestamp column.
+	DateOrder DateOrder
+
+	// Location is the time zone of the timestamps.  If nil, the time
+	// zone bias of the header row is used, as written in the logs of
+	// typeperf -o and relog, else the local time zone.
+	Location *time.Location
+
+	// ListSeparator separates the columns.  If zero, it is taken from the
+	// header row, where it follows the first column.
+	ListSeparator rune
+
+	// DecimalSeparator separates the integer and the fraction of the
+	// values.  If zero, a point is used.
+	DecimalSeparator rune
+
+	// Names translates the English object and counter names to the names
+	// typeperf knows them by, eg: "Process" to "Prozess".  Names without a
+	// translation are used as is.
+	Names map[string]string
+}
+
+// defaultTypeperfLocale is the locale of an en-US system.
+var defaultTypeperfLocale = &TypeperfLocale{DateOrder: MDY}
+
+// Locales of the typeperf output on localized Windows systems.  Their
+// names only cover the cpu and main memory counters queried by this
+// package, the peak counters are left untranslated; copy and extend them
+// to query other counters.
+var (
+	TypeperfLocaleDE = &TypeperfLocale{
+		DateOrder:        DMY,
+		DecimalSeparator: ',',
+		Names: map[string]string{
+			"Process":               "Prozess",
+			"ID Process":            "Prozesskennung",
+			"% Processor Time":      "Prozessorzeit (%)",
+			"% User Time":           "Benutzerzeit (%)",
+			"% Privileged Time":     "Privilegierte Zeit (%)",
+			"Virtual Bytes":         "Virtuelle Bytes",
+			"Working Set":           "Arbeitsseiten",
+			"Working Set - Private": "Arbeitsseiten - privat",
+		},
+	}
+	TypeperfLocaleFR = &TypeperfLocale{
+		DateOrder:        DMY,
+		DecimalSeparator: ',',
+		Names: map[string]string{
+			"Process":               "Processus",
+			"ID Process":            "ID de processus",
+			"% Processor Time":      "% temps processeur",
+			"% User Time":           "% temps utilisateur",
+			"% Privileged Time":     "% temps privilégié",
+			"Private Bytes":         "Octets privés",
+			"Virtual Bytes":         "Octets virtuels",
+			"Working Set":           "Plage de travail",
+			"Working Set - Private": "Plage de travail - privée",
+		},
+	}
+)
+
+func (l *TypeperfLocale) location() *time.Location {
+	if l.Location == nil {
+		return time.Local
+	}
+	return l.Location
+}
+
+// parseFloat parses a value written with the decimal separator of the
+// locale.
+func (l *TypeperfLocale) parseFloat(s string) (float64, error) {
+	if l.DecimalSeparator != 0 && l.DecimalSeparator != '.' {
+		s = strings.Replace(s, string(l.DecimalSeparator), ".", 1)
+	}
+	return strconv.ParseFloat(s, 64)
+}
+
+// LocalPath translates the object and counter names of an English counter
+// path to the names of the locale.
+func (l *TypeperfLocale) LocalPath(path string) string {
+	if len(l.Names) == 0 {
+		return path
+	}
+	return translatePath(path, func(name string) string {
+		for en, local := range l.Names {
+			if strings.EqualFold(name, en) {
+				return local
+			}
+		}
+		return name
+	})
+}
+
+// EnglishPath translates the object and counter names of a counter path
+// written in the language of the locale back to English.
+func (l *TypeperfLocale) EnglishPath(path string) string {
+	if len(l.Names) == 0 {
+		return path
+	}
+	return translatePath(path, func(name string) string {
+		for en, local := range l.Names {
+			if strings.EqualFold(name, local) {
+				return en
+			}
+		}
+		return name
+	})
+}
+
+// translatePath translates the object and counter names of a counter
+// path, leaving the machine and instance names alone.
+func translatePath(path string, translate func(string) string) string {
+	p, err := ParseCounterPath(path)
+	if err != nil {
+		return path
+	}
+	p.Object = translate(p.Object)
+	p.Counter = translate(p.Counter)
+	return p.String()
+}
+
+// ParseTime parses a typeperf timestamp, such as "04/17/2016 15:38:00.016".
+// Date and time fields may be separated by any non digit, as with the
+// dotted "15.38.00.016" time format of some regions.
+func (l *TypeperfLocale) ParseTime(s string) (time.Time, error) {
+	parts := strings.Fields(s)
+	if len(parts) != 2 {
+		return time.Time{}, fmt.Errorf("invalid typeperf time %q", s)
+	}
+	date := splitDigits(parts[0])
+	clock := splitDigits(parts[1])
+	if len(date) != 3 || len(clock) < 3 || len(clock) > 4 {
+		return time.Time{}, fmt.Errorf("invalid typeperf time %q", s)
+	}
+
+	var y, m, d string
+	switch l.DateOrder {
+	case DMY:
+		d, m, y = date[0], date[1], date[2]
+	case YMD:
+		y, m, d = date[0], date[1], date[2]
+	default:
+		m, d, y = date[0], date[1], date[2]
+	}
+
+	var n [6]int
+	for i, f := range []string{y, m, d, clock[0], clock[1], clock[2]} {
+		n[i], _ = strconv.Atoi(f)
+	}
+	var nsec int
+	if len(clock) == 4 {
+		// fraction of a second, eg: 016 milliseconds
+		frac := clock[3]
+		if len(frac) > 9 {
+			frac = frac[:9]
+		}
+		nsec, _ = strconv.Atoi(frac + strings.Repeat("0", 9-len(frac)))
+	}
+	if n[1] < 1 || n[1] > 12 || n[2] < 1 || n[2] > 31 || n[3] > 23 || n[4] > 59 || n[5] > 59 {
+		return time.Time{}, fmt.Errorf("invalid typeperf time %q", s)
+	}
+	t := time.Date(n[0], time.Month(n[1]), n[2], n[3], n[4], n[5], nsec, l.location())
+	// time.Date normalizes days past the end of the month, such as 02/31
+	if t.Month() != time.Month(n[1]) || t.Day() != n[2] {
+		return time.Time{}, fmt.Errorf("invalid typeperf time %q", s)
+	}
+	return t, nil
+}
+
+// splitDigits returns the runs of digits of s.
+func splitDigits(s string) []string {
+	return strings.FieldsFunc(s, func(r rune) bool {
+		return !unicode.IsDigit(r)
+	})
+}
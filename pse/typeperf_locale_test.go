@@ -0,0 +1,110 @@
+package pse
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTypeperfLocalePaths(t *testing.T) {
+	tests := []struct {
+		locale  *TypeperfLocale
+		english string
+		local   string
+	}{
+		{defaultTypeperfLocale, `\Process(gnatsd)\% Processor Time`, `\Process(gnatsd)\% Processor Time`},
+		{TypeperfLocaleDE, `\Process(gnatsd*)\% Processor Time`, `\Prozess(gnatsd*)\Prozessorzeit (%)`},
+		{TypeperfLocaleDE, `\\HOST\Process(gnatsd#1)\ID Process`, `\\HOST\Prozess(gnatsd#1)\Prozesskennung`},
+		{TypeperfLocaleDE, `\Process(Process)\Handle Count`, `\Prozess(Process)\Handle Count`},
+		{TypeperfLocaleFR, `\Process(gnatsd)\Working Set - Private`, `\Processus(gnatsd)\Plage de travail - privée`},
+		{TypeperfLocaleFR, `\Process\% User Time`, `\Processus\% temps utilisateur`},
+		{TypeperfLocaleFR, `not a path`, `not a path`},
+	}
+	for _, tt := range tests {
+		if got := tt.locale.LocalPath(tt.english); got != tt.local {
+			t.Errorf("LocalPath(%q) = %q, want %q", tt.english, got, tt.local)
+		}
+		if got := tt.locale.EnglishPath(tt.local); got != tt.english {
+			t.Errorf("EnglishPath(%q) = %q, want %q", tt.local, got, tt.english)
+		}
+	}
+
+	// names are matched without regard to case, as perfmon does
+	if got := TypeperfLocaleDE.EnglishPath(`\PROZESS(x)\prozesskennung`); got != `\Process(x)\ID Process` {
+		t.Errorf("EnglishPath = %q", got)
+	}
+}
+
+func TestTypeperfLocaleParseFloat(t *testing.T) {
+	tests := []struct {
+		locale *TypeperfLocale
+		s      string
+		v      float64
+		ok     bool
+	}{
+		{defaultTypeperfLocale, "1.562500", 1.5625, true},
+		{defaultTypeperfLocale, "5123", 5123, true},
+		{defaultTypeperfLocale, "1,5", 0, false},
+		{TypeperfLocaleDE, "1,562500", 1.5625, true},
+		{TypeperfLocaleDE, "1.5", 1.5, true},
+		{TypeperfLocaleFR, "4331663360,000000", 4331663360, true},
+		{TypeperfLocaleFR, "1,5,0", 0, false},
+		{TypeperfLocaleFR, "", 0, false},
+	}
+	for _, tt := range tests {
+		v, err := tt.locale.parseFloat(tt.s)
+		if (err == nil) != tt.ok || v != tt.v {
+			t.Errorf("parseFloat(%q) = %v, %v, want %v", tt.s, v, err, tt.v)
+		}
+	}
+}
+
+func TestTypeperfLocaleParseTime(t *testing.T) {
+	date := func(y int, m time.Month, d, h, min, sec, msec int) time.Time {
+		return time.Date(y, m, d, h, min, sec, msec*1e6, time.UTC)
+	}
+	tests := []struct {
+		order DateOrder
+		s     string
+		t     time.Time // zero for an error
+	}{
+		{MDY, "04/17/2016 15:38:00.016", date(2016, 4, 17, 15, 38, 0, 16)},
+		{MDY, "04/17/2016 15.38.00.016", date(2016, 4, 17, 15, 38, 0, 16)},
+		{MDY, "04/17/2016 15:38:00", date(2016, 4, 17, 15, 38, 0, 0)},
+		{MDY, "04/17/2016 15:38:00.5", date(2016, 4, 17, 15, 38, 0, 500)},
+		{DMY, "17.04.2016 15:38:00.016", date(2016, 4, 17, 15, 38, 0, 16)},
+		{DMY, "17/04/2016 15:38:00.016", date(2016, 4, 17, 15, 38, 0, 16)},
+		{YMD, "2016-04-17 15:38:00.016", date(2016, 4, 17, 15, 38, 0, 16)},
+		{MDY, "02/29/2016 00:00:00.000", date(2016, 2, 29, 0, 0, 0, 0)},
+
+		// day past the end of the month, normalized by time.Date
+		{MDY, "02/31/2016 15:38:00.016", time.Time{}},
+		{MDY, "02/29/2015 15:38:00.016", time.Time{}},
+		{DMY, "31.04.2016 15:38:00.016", time.Time{}},
+
+		// fields out of range, or in the wrong order
+		{MDY, "17/04/2016 15:38:00.016", time.Time{}},
+		{MDY, "04/17/2016 24:00:00.000", time.Time{}},
+		{MDY, "04/17/2016 15:60:00.000", time.Time{}},
+		{MDY, "04/17/2016 15:38:60.000", time.Time{}},
+		{MDY, "00/17/2016 15:38:00.000", time.Time{}},
+
+		// malformed
+		{MDY, "04/17/2016", time.Time{}},
+		{MDY, "04/17 15:38:00", time.Time{}},
+		{MDY, "04/17/2016 15:38", time.Time{}},
+		{MDY, "", time.Time{}},
+	}
+	for _, tt := range tests {
+		l := &TypeperfLocale{DateOrder: tt.order, Location: time.UTC}
+		got, err := l.ParseTime(tt.s)
+		if tt.t.IsZero() {
+			if err == nil {
+				t.Errorf("ParseTime(%q) = %v, want an error", tt.s, got)
+			}
+			continue
+		}
+		if err != nil || !got.Equal(tt.t) {
+			t.Errorf("ParseTime(%q) = %v, %v, want %v", tt.s, got, err, tt.t)
+		}
+	}
+}
@@ -0,0 +1,419 @@
+package pse
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// Default delays before restarting a typeperf process that exited.
+const (
+	DefaultRestartDelay    = time.Second
+	DefaultMaxRestartDelay = time.Minute
+)
+
+// TypeperfStream runs a single long lived typeperf process sampling a set
+// of counters at a fixed interval, and parses its output into records as
+// they are written.  The process is restarted if it exits.
+type TypeperfStream struct {
+	// Counters are the English counter paths to sample, translated with
+	// the locale.  Wildcards are expanded by typeperf when it starts.  If
+	// there are many, they are passed in a counter file.
+	Counters []string
+
+	// Interval is the sample interval, rounded up to the second.
+	Interval time.Duration
+
+	// RestartDelay is the time waited before restarting typeperf.  If
+	// zero, DefaultRestartDelay is used.
+	RestartDelay time.Duration
+
+	// MaxRestartDelay bounds the restart delay, which doubles each time
+	// typeperf exits without writing a sample, as it does at once when no
+	// instance matches its counters.  If zero, DefaultMaxRestartDelay is
+	// used.
+	MaxRestartDelay time.Duration
+
+	// Locale is the locale of the typeperf output.  If nil, the en-US
+	// locale is assumed.  The counters of the records are in English.
+	Locale *TypeperfLocale
+
+	// Runner starts typeperf.  If nil, typeperf is run with os/exec.
+	// Tests may substitute a process writing canned typeperf output.
+	Runner Runner
+
+	mu      sync.Mutex
+	proc    Process
+	err     error
+	started bool
+	stop    chan struct{}
+	restart chan struct{}
+	done    chan struct{}
+
+	// counter arguments, set when the stream is started
+	counterArgs []string
+	counterFile string
+}
+
+// errStreamStarted is returned when starting a stream twice.
+var errStreamStarted = errors.New("pse: typeperf stream already started")
+
+// Args returns the typeperf arguments of the started stream.
+func (s *TypeperfStream) Args() []string {
+	args := append([]string{}, s.counterArgs...)
+	return append(args, "-si", fmt.Sprintf("%d", s.interval()/time.Second))
+}
+
+// interval returns the sample interval of typeperf, in whole seconds.
+func (s *TypeperfStream) interval() time.Duration {
+	secs := (s.Interval + time.Second - 1) / time.Second
+	if secs < 1 {
+		secs = 1
+	}
+	return secs * time.Second
+}
+
+func (s *TypeperfStream) restartDelay() time.Duration {
+	if s.RestartDelay == 0 {
+		return DefaultRestartDelay
+	}
+	return s.RestartDelay
+}
+
+// nextRestartDelay returns the restart delay following delay, when
+// typeperf exits again without writing a sample.
+func (s *TypeperfStream) nextRestartDelay(delay time.Duration) time.Duration {
+	max := s.MaxRestartDelay
+	if max == 0 {
+		max = DefaultMaxRestartDelay
+	}
+	if delay *= 2; delay > max {
+		delay = max
+	}
+	return delay
+}
+
+// Start starts typeperf and returns the channel receiving the records.
+// The channel is closed once the stream is stopped.
+func (s *TypeperfStream) Start() (<-chan *TypeperfRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.started {
+		return nil, errStreamStarted
+	}
+	locale := s.Locale
+	if locale == nil {
+		locale = defaultTypeperfLocale
+	}
+	args, counterFile, err := typeperfCounterArgs(locale, s.Counters)
+	if err != nil {
+		return nil, err
+	}
+	s.counterArgs = args
+	s.counterFile = counterFile
+	s.started = true
+	s.stop = make(chan struct{})
+	s.restart = make(chan struct{}, 1)
+	s.done = make(chan struct{})
+
+	records := make(chan *TypeperfRecord)
+	go s.run(records)
+	return records, nil
+}
+
+// Stop stops typeperf and waits for the stream to end.
+func (s *TypeperfStream) Stop() {
+	s.mu.Lock()
+	if !s.started {
+		s.mu.Unlock()
+		return
+	}
+	select {
+	case <-s.stop:
+	default:
+		close(s.stop)
+	}
+	s.killLocked()
+	s.mu.Unlock()
+
+	<-s.done
+}
+
+// Restart kills the running typeperf, which is started again at once, as
+// it is if waiting to be restarted.  It is used to expand wildcard
+// counters again.
+func (s *TypeperfStream) Restart() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.started {
+		return
+	}
+	s.killLocked()
+	select {
+	case s.restart <- struct{}{}:
+	default:
+	}
+}
+
+// Err returns the error that ended the last typeperf process, if any.
+func (s *TypeperfStream) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+// killLocked kills typeperf, closing its output so that reading it does
+// not block on a process it may have started.
+func (s *TypeperfStream) killLocked() {
+	if s.proc != nil {
+		s.proc.Kill()
+		s.proc.Stdout().Close()
+	}
+}
+
+func (s *TypeperfStream) run(records chan<- *TypeperfRecord) {
+	defer close(s.done)
+	defer close(records)
+	if s.counterFile != "" {
+		defer os.Remove(s.counterFile)
+	}
+
+	delay := s.restartDelay()
+	for {
+		sampled, err := s.runOnce(records)
+
+		s.mu.Lock()
+		s.err = err
+		s.proc = nil
+		s.mu.Unlock()
+
+		if sampled {
+			delay = s.restartDelay()
+		}
+		select {
+		case <-s.stop:
+			return
+		case <-s.restart:
+			delay = s.restartDelay()
+		case <-time.After(delay):
+			delay = s.nextRestartDelay(delay)
+		}
+	}
+}
+
+// runOnce runs typeperf until it exits or the stream is stopped, and
+// reports whether it wrote any sample.
+func (s *TypeperfStream) runOnce(records chan<- *TypeperfRecord) (bool, error) {
+	runner := s.Runner
+	if runner == nil {
+		runner = execRunner{}
+	}
+
+	// started under the lock, so that Stop kills it
+	s.mu.Lock()
+	select {
+	case <-s.stop:
+		s.mu.Unlock()
+		return false, nil
+	default:
+	}
+	proc, err := runner.Start("typeperf", s.Args()...)
+	if err != nil {
+		s.mu.Unlock()
+		return false, err
+	}
+	s.proc = proc
+	s.mu.Unlock()
+
+	r := newTypeperfReader(proc.Stdout(), s.Locale)
+	sampled := false
+	var readErr error
+	for {
+		rec, err := r.Read()
+		if err != nil {
+			readErr = err
+			break
+		}
+		sampled = true
+		select {
+		case records <- rec:
+		case <-s.stop:
+		}
+	}
+	// on a parse error typeperf would block writing its output
+	if readErr != io.EOF {
+		proc.Kill()
+	}
+	res, err := proc.Wait()
+	switch {
+	case err != nil:
+	case uint32(res.ExitCode) > 0xFFFF:
+		// typeperf failed with a PDH status, its output being the
+		// message
+		err = typeperfExitError(res)
+	case readErr != io.EOF:
+		err = readErr
+	case res.ExitCode != 0:
+		err = typeperfExitError(res)
+	default:
+		err = errors.New("typeperf exited")
+	}
+	return sampled, err
+}
+
+// typeperfStreamBackend retrieves process usage from the records of a
+// typeperf stream sampling every instance of the image.
+type typeperfStreamBackend struct {
+	opts   *Options
+	stream *TypeperfStream
+
+	mu          sync.Mutex
+	latest      *TypeperfRecord
+	lastRestart time.Time
+
+	cpu *counterCPU
+}
+
+// minStreamRestartInterval limits how often the stream is restarted to
+// pick up new instances.
+const minStreamRestartInterval = 10 * time.Second
+
+var (
+	// ErrNoSample is returned when a streaming backend has not received
+	// a sample yet.
+	ErrNoSample = errors.New("pse: no sample received yet")
+
+	// ErrStaleSample is returned when a streaming backend has not
+	// received a sample for two intervals, and typeperf did not report
+	// an error.
+	ErrStaleSample = errors.New("pse: no sample received lately")
+)
+
+func openTypeperfStreamBackend(opts *Options) (Backend, error) {
+	c := newProcessCounters(opts.ImageName+"*", opts.TypeperfCounters)
+	b := &typeperfStreamBackend{
+		opts: opts,
+		stream: &TypeperfStream{
+			Counters: c.paths(),
+			Interval: opts.StreamInterval,
+			Locale:   opts.TypeperfLocale,
+			Runner:   opts.Runner,
+		},
+		lastRestart: time.Now(),
+		cpu:         newCounterCPU(opts),
+	}
+	records, err := b.stream.Start()
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		for rec := range records {
+			b.mu.Lock()
+			b.latest = rec
+			b.mu.Unlock()
+		}
+	}()
+	return b, nil
+}
+
+// UsageForPID implements Backend.  typeperf expands the wildcard counters
+// when it starts, so the stream is restarted when the pid is not found, in
+// case it belongs to a new instance.
+func (b *typeperfStreamBackend) UsageForPID(pid int) (Usage, error) {
+	usages, err := b.latestUsages()
+	if err != nil {
+		return Usage{}, err
+	}
+	u, ok := usages[pid]
+	if !ok {
+		b.restart()
+		return Usage{}, ErrNotFound
+	}
+	return u, nil
+}
+
+// SnapshotAll implements Backend, returning the usages of the latest
+// record.  The stream is restarted from time to time to pick up the new
+// instances.
+func (b *typeperfStreamBackend) SnapshotAll() (map[int]Usage, error) {
+	usages, err := b.latestUsages()
+	b.restart()
+	return usages, err
+}
+
+// latestUsages returns the usages of the latest record, unless typeperf
+// has not written one for two intervals, on top of the time to restart it.
+func (b *typeperfStreamBackend) latestUsages() (map[int]Usage, error) {
+	b.mu.Lock()
+	rec := b.latest
+	b.mu.Unlock()
+
+	if rec == nil {
+		if err := b.stream.Err(); err != nil {
+			return nil, err
+		}
+		return nil, ErrNoSample
+	}
+	if time.Since(rec.Collected) > 2*b.stream.interval()+b.stream.restartDelay() {
+		if err := b.stream.Err(); err != nil {
+			return nil, err
+		}
+		return nil, ErrStaleSample
+	}
+	usages := usagesFromRecord(rec, b.opts)
+	b.cpu.convertAll(usages)
+	return usages, nil
+}
+
+// restart restarts the stream, unless it was restarted lately.
+func (b *typeperfStreamBackend) restart() {
+	if time.Since(b.lastRestart) >= minStreamRestartInterval {
+		b.lastRestart = time.Now()
+		b.stream.Restart()
+	}
+}
+
+// Close implements Backend, stopping the stream.
+func (b *typeperfStreamBackend) Close() error {
+	b.stream.Stop()
+	return nil
+}
+
+// instancesFromRecord returns the name of every instance of a record that
+// matches the image name of the options, by pid.
+func instancesFromRecord(rec *TypeperfRecord, opts *Options) map[int]string {
+	instances := make(map[int]string)
+	for _, key := range rec.Counters() {
+		p, err := ParseCounterPath(key)
+		if err != nil || p.Object != "process" || p.Counter != "id process" {
+			continue
+		}
+		inst := p.InstanceName()
+		if !opts.matchImage(inst) {
+			continue
+		}
+		if v, ok := rec.Value(key); ok {
+			instances[int(v)] = inst
+		}
+	}
+	return instances
+}
+
+// usagesFromRecord returns the usage of every instance of a record that
+// matches the image name of the options, by pid.
+func usagesFromRecord(rec *TypeperfRecord, opts *Options) map[int]Usage {
+	instances := instancesFromRecord(rec, opts)
+	usages := make(map[int]Usage, len(instances))
+	for pid, inst := range instances {
+		var u Usage
+		var ppid int
+		newProcessCounters(inst, opts.TypeperfCounters).usage(rec, &ppid, &u)
+		u.PID = pid
+		usages[pid] = u
+	}
+	return usages
+}
@@ -0,0 +1,339 @@
+package pse
+
+import (
+	"errors"
+	"io"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeProcess is a Process writing canned output, then exiting with the
+// given code, or waiting until killed if held.  Killed processes exit
+// with code 1.
+type fakeProcess struct {
+	stdout   *io.PipeReader
+	exitCode int
+	kill     sync.Once
+	killed   chan struct{}
+	exited   chan struct{}
+}
+
+func startFakeProcess(output string, exitCode int, hold bool) *fakeProcess {
+	r, w := io.Pipe()
+	p := &fakeProcess{
+		stdout:   r,
+		exitCode: exitCode,
+		killed:   make(chan struct{}),
+		exited:   make(chan struct{}),
+	}
+	go func() {
+		defer close(p.exited)
+		io.WriteString(w, output)
+		if hold {
+			<-p.killed
+			p.exitCode = 1
+		}
+		w.Close()
+	}()
+	return p
+}
+
+func (p *fakeProcess) Stdout() io.ReadCloser {
+	return p.stdout
+}
+
+func (p *fakeProcess) Kill() error {
+	p.kill.Do(func() { close(p.killed) })
+	return nil
+}
+
+func (p *fakeProcess) Wait() (*RunResult, error) {
+	<-p.exited
+	return &RunResult{ExitCode: p.exitCode}, nil
+}
+
+// streamRunner is a Runner whose processes write the same typeperf
+// output, then exit or, if held, wait until killed.
+type streamRunner struct {
+	output string
+	hold   bool
+
+	mu   sync.Mutex
+	args []string // of the last process
+}
+
+func (r *streamRunner) Run(name string, args ...string) (*RunResult, error) {
+	return nil, errors.New("streamRunner only runs streams")
+}
+
+func (r *streamRunner) Start(name string, args ...string) (Process, error) {
+	r.mu.Lock()
+	r.args = args
+	r.mu.Unlock()
+	return startFakeProcess(r.output, 0, r.hold), nil
+}
+
+const streamOutput = "\r\n" +
+	`"(PDH-CSV 4.0)","\\HOST\Process(gnatsd)\ID Process","\\HOST\Process(gnatsd#1)\ID Process","\\HOST\Process(gnatsd)\% Processor Time","\\HOST\Process(gnatsd#1)\% Processor Time"` + "\r\n" +
+	`"04/17/2016 15:38:00.016","5123.000000","6042.000000","12.500000"," "` + "\r\n" +
+	`"04/17/2016 15:38:01.016","5123.000000","6042.000000","25.000000","100.000000"` + "\r\n"
+
+func TestTypeperfStream(t *testing.T) {
+	runner := &streamRunner{output: streamOutput}
+	s := &TypeperfStream{
+		Counters:     []string{`\Process(gnatsd*)\ID Process`, `\Process(gnatsd*)\% Processor Time`},
+		Interval:     1500 * time.Millisecond,
+		RestartDelay: 10 * time.Millisecond,
+		Runner:       runner,
+	}
+	records, err := s.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+	if _, err := s.Start(); err != errStreamStarted {
+		t.Fatalf("second Start: %v, want errStreamStarted", err)
+	}
+
+	// the fake typeperf exits after two records, and is restarted
+	opts := &Options{ImageName: "gnatsd"}
+	for i := 0; i < 4; i++ {
+		var rec *TypeperfRecord
+		select {
+		case rec = <-records:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("record %d not received", i)
+		}
+		sec := i % 2
+		if rec.Time.Second() != sec {
+			t.Errorf("record %d: time %v", i, rec.Time)
+		}
+		usages := usagesFromRecord(rec, opts)
+		if len(usages) != 2 || usages[5123].CPU != 12.5*float64(1+sec) {
+			t.Errorf("record %d: usages %+v", i, usages)
+		}
+		// the time is that of the source, the local time being kept
+		if u := usages[5123]; !u.Time.Equal(rec.Time) || !u.Collected.Equal(rec.Collected) || u.Collected.IsZero() {
+			t.Errorf("record %d: time %v collected %v", i, u.Time, u.Collected)
+		}
+		if v := usages[6042].Valid.Has(MetricCPU); v != (sec == 1) {
+			t.Errorf("record %d: gnatsd#1 cpu valid %v", i, v)
+		}
+	}
+	want := []string{`\Process(gnatsd*)\ID Process`, `\Process(gnatsd*)\% Processor Time`, "-si", "2"}
+	runner.mu.Lock()
+	defer runner.mu.Unlock()
+	if !reflect.DeepEqual(runner.args, want) {
+		t.Errorf("args %q, want %q", runner.args, want)
+	}
+}
+
+func TestTypeperfStreamStop(t *testing.T) {
+	s := &TypeperfStream{
+		Counters: []string{`\Process(gnatsd*)\ID Process`},
+		Runner:   &streamRunner{output: streamOutput, hold: true},
+	}
+	records, err := s.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-records
+
+	// Stop kills the running typeperf
+	stopped := make(chan struct{})
+	go func() {
+		s.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Stop did not return")
+	}
+	for range records {
+	}
+	s.Stop()
+}
+
+// TestTypeperfStreamBackend checks that the streaming backend runs
+// typeperf through the Runner of the options.
+func TestTypeperfStreamBackend(t *testing.T) {
+	b, err := openTypeperfBackend(&Options{
+		ImageName:      "gnatsd",
+		StreamInterval: time.Second,
+		Runner:         &streamRunner{output: streamOutput, hold: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		u, err := b.UsageForPID(6042)
+		if err == nil {
+			if u.PID != 6042 || u.CPU != 100 {
+				t.Errorf("usage %+v", u)
+			}
+			return
+		}
+		if (err != ErrNoSample && err != ErrNotFound) || time.Now().After(deadline) {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// TestTypeperfStreamExitError checks that the exit code of a failed
+// typeperf is reported, as when no instance of the image runs.
+func TestTypeperfStreamExitError(t *testing.T) {
+	b, err := openTypeperfBackend(&Options{
+		ImageName:      "gnatsd",
+		StreamInterval: time.Second,
+		Runner:         &fakeTypeperf{},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		_, err := b.SnapshotAll()
+		if err == errNoValidData {
+			return
+		}
+		if err != ErrNoSample || time.Now().After(deadline) {
+			t.Fatalf("got %v, want errNoValidData", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// waitFor polls cond until it holds, failing the test after 5 seconds.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestTypeperfStreamRestartDelay(t *testing.T) {
+	tests := []struct {
+		max   time.Duration
+		delay time.Duration
+		want  time.Duration
+	}{
+		{0, time.Second, 2 * time.Second},
+		{0, 32 * time.Second, DefaultMaxRestartDelay},
+		{0, DefaultMaxRestartDelay, DefaultMaxRestartDelay},
+		{5 * time.Second, 4 * time.Second, 5 * time.Second},
+	}
+	for _, tt := range tests {
+		s := &TypeperfStream{MaxRestartDelay: tt.max}
+		if got := s.nextRestartDelay(tt.delay); got != tt.want {
+			t.Errorf("max %v: after %v got %v, want %v", tt.max, tt.delay, got, tt.want)
+		}
+	}
+}
+
+// TestTypeperfStreamRestart checks that Restart starts typeperf at once
+// when it is waiting to be restarted.
+func TestTypeperfStreamRestart(t *testing.T) {
+	f := &fakeTypeperf{}
+	s := &TypeperfStream{
+		Counters:     []string{`\Process(gnatsd*)\ID Process`},
+		RestartDelay: time.Hour,
+		Runner:       f,
+	}
+	records, err := s.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	// no instance runs, typeperf fails and waits an hour to restart
+	waitFor(t, "typeperf to fail", func() bool { return s.Err() == errNoValidData })
+	f.setInstances(fakeInstance{"gnatsd", 5123, nil})
+	s.Restart()
+	select {
+	case <-records:
+	case <-time.After(5 * time.Second):
+		t.Fatal("typeperf not restarted")
+	}
+	if n := f.runCount(); n != 2 {
+		t.Errorf("typeperf ran %d times, want 2", n)
+	}
+}
+
+func openFakeTypeperfStream(t *testing.T, f *fakeTypeperf) *typeperfStreamBackend {
+	b, err := openTypeperfBackend(&Options{ImageName: "gnatsd", StreamInterval: time.Second, Runner: f})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { b.Close() })
+	return b.(*typeperfStreamBackend)
+}
+
+// TestTypeperfStreamBackendStale checks that the latest record is not
+// reported once typeperf stopped writing them.
+func TestTypeperfStreamBackendStale(t *testing.T) {
+	b := openFakeTypeperfStream(t, &fakeTypeperf{instances: []fakeInstance{{"gnatsd", 5123, nil}}})
+	waitFor(t, "a sample", func() bool {
+		_, err := b.SnapshotAll()
+		return err == nil
+	})
+
+	b.mu.Lock()
+	rec := *b.latest
+	rec.Collected = time.Now().Add(-time.Minute)
+	b.latest = &rec
+	b.mu.Unlock()
+	if _, err := b.SnapshotAll(); err != ErrStaleSample {
+		t.Errorf("got %v, want ErrStaleSample", err)
+	}
+
+	// the error that ended typeperf is reported instead
+	b.stream.mu.Lock()
+	b.stream.err = errNoValidData
+	b.stream.mu.Unlock()
+	if _, err := b.UsageForPID(5123); err != errNoValidData {
+		t.Errorf("got %v, want errNoValidData", err)
+	}
+}
+
+// TestTypeperfStreamBackendNewInstance checks that snapshots restart the
+// stream, no more than every minStreamRestartInterval, to pick up the new
+// instances.
+func TestTypeperfStreamBackendNewInstance(t *testing.T) {
+	f := &fakeTypeperf{instances: []fakeInstance{{"gnatsd", 5123, nil}}}
+	b := openFakeTypeperfStream(t, f)
+	waitFor(t, "a sample", func() bool {
+		_, err := b.SnapshotAll()
+		return err == nil
+	})
+
+	f.setInstances(fakeInstance{"gnatsd", 5123, nil}, fakeInstance{"gnatsd#1", 7001, nil})
+	if usages, err := b.SnapshotAll(); err != nil || len(usages) != 1 {
+		t.Fatalf("got %v, %v before the restart interval", usages, err)
+	}
+	if n := f.runCount(); n != 1 {
+		t.Fatalf("typeperf ran %d times, want 1", n)
+	}
+
+	b.lastRestart = b.lastRestart.Add(-minStreamRestartInterval)
+	waitFor(t, "the new instance", func() bool {
+		usages, _ := b.SnapshotAll()
+		_, ok := usages[7001]
+		return ok
+	})
+	if n := f.runCount(); n != 2 {
+		t.Errorf("typeperf ran %d times, want 2", n)
+	}
+}
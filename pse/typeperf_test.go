@@ -0,0 +1,331 @@
+package pse
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"unicode/utf16"
+)
+
+// fakeInstance is a process instance known to fakeTypeperf.
+type fakeInstance struct {
+	name   string // instance name, eg: gnatsd#1
+	pid    int
+	values map[string]float64 // by English counter name
+}
+
+// fakeTypeperf is a Runner emulating typeperf on a set of process
+// instances, and recording the counters of each run.  Runs sample the
+// instances once, while started streams then wait until killed, as
+// typeperf does between samples.  The counters and output are in the
+// language of the locale, en-US if nil.
+type fakeTypeperf struct {
+	mu        sync.Mutex
+	locale    *TypeperfLocale
+	instances []fakeInstance
+	runs      [][]string
+}
+
+// Run implements Runner.
+func (f *fakeTypeperf) Run(name string, args ...string) (*RunResult, error) {
+	res, err := f.sample(args)
+	if err != nil || res.ExitCode != 0 {
+		return res, err
+	}
+	res.Stdout = append(res.Stdout, "Exiting, please wait...\r\nThe command completed successfully.\r\n"...)
+	return res, nil
+}
+
+// Start implements Runner.
+func (f *fakeTypeperf) Start(name string, args ...string) (Process, error) {
+	res, err := f.sample(args)
+	if err != nil {
+		return nil, err
+	}
+	return startFakeProcess(string(res.Stdout), res.ExitCode, res.ExitCode == 0), nil
+}
+
+// setInstances replaces the instances, while a stream may be sampling them.
+func (f *fakeTypeperf) setInstances(instances ...fakeInstance) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.instances = instances
+}
+
+// runCount returns the number of runs, while a stream may be starting one.
+func (f *fakeTypeperf) runCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.runs)
+}
+
+// sample writes a sample of the instances matching the counter paths of
+// the arguments, or of the counter file.
+func (f *fakeTypeperf) sample(args []string) (*RunResult, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var paths []string
+	for i := 0; i < len(args); i++ {
+		switch args[i] {
+		case "-sc", "-si":
+			i++
+		case "-cf":
+			i++
+			file, err := readCounterFile(args[i])
+			if err != nil {
+				return nil, err
+			}
+			paths = append(paths, file...)
+		default:
+			paths = append(paths, args[i])
+		}
+	}
+	f.runs = append(f.runs, paths)
+
+	locale := f.locale
+	if locale == nil {
+		locale = defaultTypeperfLocale
+	}
+	date := "04/17/2016"
+	if locale.DateOrder == DMY {
+		date = "17/04/2016"
+	}
+	header := []string{`"(PDH-CSV 4.0)"`}
+	row := []string{`"` + date + ` 15:38:00.016"`}
+	for _, path := range paths {
+		local, err := ParseCounterPath(path)
+		if err != nil {
+			return nil, err
+		}
+		// names the locale does not know are not found
+		p, err := ParseCounterPath(locale.EnglishPath(path))
+		if err != nil {
+			return nil, err
+		}
+		found := false
+		for _, inst := range f.instances {
+			pattern := p.InstanceName()
+			if inst.name != pattern && !(strings.HasSuffix(pattern, "*") && strings.HasPrefix(inst.name, strings.TrimSuffix(pattern, "*"))) {
+				continue
+			}
+			found = true
+			q := local
+			q.Machine = "BUILD01"
+			q.Instance, q.Index, q.HasIndex = splitInstanceIndex(inst.name)
+			header = append(header, `"`+q.String()+`"`)
+			v, ok := inst.values[p.Counter]
+			if p.Counter == "ID Process" {
+				v, ok = float64(inst.pid), true
+			}
+			if ok {
+				s := fmt.Sprintf("%f", v)
+				if locale.DecimalSeparator != 0 {
+					s = strings.Replace(s, ".", string(locale.DecimalSeparator), 1)
+				}
+				row = append(row, `"`+s+`"`)
+			} else {
+				row = append(row, `" "`)
+			}
+		}
+		if !found {
+			return &RunResult{
+				Stdout:   []byte("\r\nError: No valid counters.\r\n"),
+				ExitCode: PDH_CSTATUS_NO_INSTANCE,
+			}, nil
+		}
+	}
+	out := "\r\n" + strings.Join(header, ",") + "\r\n" + strings.Join(row, ",") + "\r\n"
+	return &RunResult{Stdout: []byte(out)}, nil
+}
+
+// readCounterFile reads a counter file as typeperf does: in UTF-16 if it
+// starts with a byte order mark, else in the ANSI code page, taken to be
+// Latin-1.
+func readCounterFile(name string) ([]string, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	var text string
+	if len(data) >= 2 && data[0] == 0xFF && data[1] == 0xFE {
+		units := make([]uint16, (len(data)-2)/2)
+		for i := range units {
+			units[i] = uint16(data[2+2*i]) | uint16(data[3+2*i])<<8
+		}
+		text = string(utf16.Decode(units))
+	} else {
+		runes := make([]rune, len(data))
+		for i, b := range data {
+			runes[i] = rune(b)
+		}
+		text = string(runes)
+	}
+	var paths []string
+	for _, line := range strings.Split(text, "\r\n") {
+		if line != "" {
+			paths = append(paths, line)
+		}
+	}
+	return paths, nil
+}
+
+func openFakeTypeperf(t *testing.T, f *fakeTypeperf, opts *Options) *typeperfBackend {
+	opts.ImageName = "gnatsd"
+	opts.Runner = f
+	b, err := openTypeperfBackend(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b.(*typeperfBackend)
+}
+
+// TestTypeperfUsageForPIDRenamed checks that a process is found once its
+// instance is renamed, as another instance of the image exits.
+func TestTypeperfUsageForPIDRenamed(t *testing.T) {
+	f := &fakeTypeperf{instances: []fakeInstance{
+		{"gnatsd", 5123, map[string]float64{"% Processor Time": 10}},
+		{"gnatsd#1", 6042, map[string]float64{"% Processor Time": 20}},
+		{"gnatsd#2", 7001, map[string]float64{"% Processor Time": 30, "Working Set": 4096}},
+	}}
+	b := openFakeTypeperf(t, f, &Options{})
+
+	// the first sample resolves the instance names with a wildcard query
+	u, err := b.UsageForPID(7001)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.PID != 7001 || u.CPU != 30 || u.Memory.WorkingSet != 4096 || len(f.runs) != 1 {
+		t.Fatalf("usage %+v after %d runs", u, len(f.runs))
+	}
+	if p := f.runs[0][0]; p != `\Process(gnatsd*)\ID Process` {
+		t.Fatalf("first run queried %q", p)
+	}
+
+	// then the cached instance is queried
+	f.runs = nil
+	if u, err = b.UsageForPID(7001); err != nil || u.CPU != 30 {
+		t.Fatalf("usage %+v, %v", u, err)
+	}
+	if len(f.runs) != 1 || f.runs[0][0] != `\Process(gnatsd#2)\ID Process` {
+		t.Fatalf("runs %q", f.runs)
+	}
+
+	// gnatsd#1 exits, and 7001 is renamed gnatsd#1: the cached name is
+	// that of another process, so every instance is queried again.
+	f.instances = []fakeInstance{
+		{"gnatsd", 5123, map[string]float64{"% Processor Time": 10}},
+		{"gnatsd#1", 7001, map[string]float64{"% Processor Time": 40}},
+	}
+	f.runs = nil
+	if u, err = b.UsageForPID(7001); err != nil || u.PID != 7001 || u.CPU != 40 {
+		t.Fatalf("usage %+v, %v", u, err)
+	}
+	if len(f.runs) != 2 || f.runs[0][0] != `\Process(gnatsd#2)\ID Process` || f.runs[1][0] != `\Process(gnatsd*)\ID Process` {
+		t.Fatalf("runs %q", f.runs)
+	}
+	if b.imageNames[7001] != "gnatsd#1" {
+		t.Fatalf("cached names %v", b.imageNames)
+	}
+
+	// a process that exited is not found
+	if _, err := b.UsageForPID(6042); err != ErrNotFound {
+		t.Fatalf("got %v, want ErrNotFound", err)
+	}
+
+	// nor is any once every instance exited
+	f.instances = nil
+	if _, err := b.UsageForPID(7001); err != ErrNotFound {
+		t.Fatalf("got %v, want ErrNotFound", err)
+	}
+}
+
+func TestTypeperfSnapshotAll(t *testing.T) {
+	f := &fakeTypeperf{instances: []fakeInstance{
+		{"gnatsd", 5123, map[string]float64{"% Processor Time": 10, "Handle Count": 55, "Thread Count": 7}},
+		{"gnatsd#1", 6042, map[string]float64{"Working Set": 8192}},
+		{"gnatsdx", 8000, nil},
+	}}
+	b := openFakeTypeperf(t, f, &Options{TypeperfCounters: []TypeperfCounter{
+		{Metric: "handles", Counter: "Handle Count"},
+		{Metric: "threads", Counter: "Thread Count"},
+	}})
+
+	usages, err := b.SnapshotAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(usages) != 2 {
+		t.Fatalf("usages %+v", usages)
+	}
+	u := usages[5123]
+	if u.CPU != 10 || u.Counters["handles"] != 55 || u.Counters["threads"] != 7 || u.Valid.Has(MetricWorkingSet) {
+		t.Errorf("gnatsd usage %+v", u)
+	}
+	u = usages[6042]
+	if u.Memory.WorkingSet != 8192 || u.Valid.Has(MetricCPU) || u.Counters != nil {
+		t.Errorf("gnatsd#1 usage %+v", u)
+	}
+
+	// the counters exceed the command line, and are passed in a file
+	if len(f.runs) != 1 || len(f.runs[0]) != maxArgCounters+2 {
+		t.Errorf("runs %q", f.runs)
+	}
+}
+
+func TestTypeperfExitError(t *testing.T) {
+	tests := []struct {
+		res *RunResult
+		err error
+	}{
+		{&RunResult{ExitCode: PDH_INVALID_DATA}, errNoValidData},
+		{&RunResult{ExitCode: PDH_CSTATUS_NO_INSTANCE}, errNoValidData},
+		{&RunResult{ExitCode: 1, Stdout: []byte("Error: The data is not valid.")}, errNoValidData},
+		{&RunResult{ExitCode: PDH_CSTATUS_NO_OBJECT}, ErrPdhNoObject},
+	}
+	for _, tt := range tests {
+		if err := typeperfExitError(tt.res); !errors.Is(err, tt.err) {
+			t.Errorf("exit code %#x: got %v, want %v", uint32(tt.res.ExitCode), err, tt.err)
+		}
+	}
+	if err := typeperfExitError(&RunResult{ExitCode: 2}); err == nil {
+		t.Error("exit code 2: no error")
+	}
+}
+
+func TestTypeperfSecondsTotal(t *testing.T) {
+	_, err := openTypeperfBackend(&Options{ImageName: "gnatsd", CPUMode: CPUSecondsTotal, Runner: &fakeTypeperf{}})
+	if !errors.Is(err, ErrCPUModeUnsupported) {
+		t.Errorf("got %v, want ErrCPUModeUnsupported", err)
+	}
+}
+
+// TestTypeperfCounterFileLocale checks that localized counter names reach
+// typeperf intact through a counter file.
+func TestTypeperfCounterFileLocale(t *testing.T) {
+	f := &fakeTypeperf{locale: TypeperfLocaleFR, instances: []fakeInstance{
+		{"gnatsd", 5123, map[string]float64{"% Privileged Time": 1.5, "Private Bytes": 8192, "Handle Count": 55}},
+	}}
+	b := openFakeTypeperf(t, f, &Options{
+		TypeperfLocale:   TypeperfLocaleFR,
+		RSSMetric:        MetricPrivateBytes,
+		TypeperfCounters: []TypeperfCounter{{Metric: "handles", Counter: "Handle Count"}},
+	})
+
+	u, err := b.UsageForPID(5123)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(f.runs) != 1 || len(f.runs[0]) != maxArgCounters+1 {
+		t.Fatalf("runs %q", f.runs)
+	}
+	if p := f.runs[0][6]; p != `\Processus(gnatsd*)\Octets privés` {
+		t.Errorf("typeperf read %q from the counter file", p)
+	}
+	if u.KernelCPU != 1.5 || u.Memory.PrivateBytes != 8192 || u.Counters["handles"] != 55 {
+		t.Errorf("usage %+v", u)
+	}
+}
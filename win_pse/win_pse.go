@@ -1,277 +1,195 @@
-// +build windows
-
+// Command win_pse repeatedly prints the process usage of itself, or of
+// another process, as reported by one of the pse backends.
 package main
 
 import (
+	"flag"
 	"fmt"
-	"syscall"
+	"io"
+	"os"
+	"sort"
+	"strings"
 	"time"
-	"unsafe"
-)
 
-var (
-	pdh                            = syscall.NewLazyDLL("pdh.dll")
-	winPdhOpenQuery                = pdh.NewProc("PdhOpenQuery")
-	winPdhCloseQuery               = pdh.NewProc("PdhCloseQuery")
-	winPdhAddCounter               = pdh.NewProc("PdhAddCounterW")
-	winPdhCollectQueryData         = pdh.NewProc("PdhCollectQueryData")
-	winPdhGetFormattedCounterValue = pdh.NewProc("PdhGetFormattedCounterValue")
-	winPdhGetFormattedCounterArray = pdh.NewProc("PdhGetFormattedCounterArrayW")
+	"github.com/ColinSullivan1/misc-projects/pse"
 )
 
-// global performance counter query handle and counters
-var (
-    pcHandle PDH_HQUERY
-    pidCounter, cpuCounter, rssCounter, vssCounter PDH_HCOUNTER
-    initialSample = true
-    prevCPU float64
-    prevRss int64
-    prevVss int64
-    lastSampleTime time.Time	
-)
-
-// maximum servers queried (running on this machine simulaneously).
-const maxQuerySize = 128
-
-// Keep static memory around to reuse.
-var counterResults [maxQuerySize]PDH_FMT_COUNTERVALUE_ITEM_DOUBLE
-
-// PDH Types
-type (
-	PDH_HQUERY   syscall.Handle // query handle
-	PDH_HCOUNTER syscall.Handle // counter handle
-)
-
-// PDH constants used here
-const (
-	PDH_FMT_DOUBLE   = 0x00000200
-	PDH_INVALID_DATA = 0xC0000BC6
-	PDH_MORE_DATA    = 0x800007D2
-)
-
-// PDH_FMT_COUNTERVALUE_DOUBLE - double value 
-type PDH_FMT_COUNTERVALUE_DOUBLE struct {
-	CStatus     uint32
-	DoubleValue float64
-}
-
-// PDH_FMT_COUNTERVALUE_ITEM_DOUBLE is an array 
-// element of a double value
-type PDH_FMT_COUNTERVALUE_ITEM_DOUBLE struct {
-	SzName   *uint16 // pointer to a string
-	FmtValue PDH_FMT_COUNTERVALUE_DOUBLE
-}
-
-func pdhAddCounter(hQuery PDH_HQUERY, szFullCounterPath string, dwUserData uintptr, phCounter *PDH_HCOUNTER) error {
-	ptxt, _ := syscall.UTF16PtrFromString(szFullCounterPath)
-	r0, _, _ := winPdhAddCounter.Call(
-		uintptr(hQuery),
-		uintptr(unsafe.Pointer(ptxt)),
-		dwUserData,
-		uintptr(unsafe.Pointer(phCounter)))
-
-	if r0 != 0 {
-		return fmt.Errorf("pdhAddCounter failed. %d", r0)
+func main() {
+	backend := flag.String("backend", "", "backend to use ("+strings.Join(pse.Backends(), ", ")+")")
+	count := flag.Int("n", 100000, "number of samples")
+	interval := flag.Duration("i", 250*time.Millisecond, "sample interval")
+	pid := flag.Int("pid", os.Getpid(), "process id to sample")
+	image := flag.String("image", "", "process image name (default: this program)")
+	wildcard := flag.Bool("wildcard", false, "match images starting with the image name")
+	all := flag.Bool("all", false, "sample every process matching the image name")
+	stream := flag.Duration("stream", 0, "typeperf backend: run a single typeperf sampling at this interval")
+	locale := flag.String("locale", "", "typeperf backend: language of the system (de, fr), if not English")
+	counters := flag.String("counters", "", "typeperf backend: additional Process counters, eg: \"handles=Handle Count,threads=Thread Count\"")
+	replay := flag.String("replay", "", "replay a typeperf or relog CSV log rather than sampling")
+	verbose := flag.Bool("v", false, "print the sampler diagnostics")
+	cpu := flag.String("cpu", "percore", "cpu reported: percore, machine or seconds (not with typeperf or replay)")
+	system := flag.Bool("system", false, "also print the usage of the machine")
+	rss := flag.String("rss", "workingset", "memory reported as rss: "+memoryNames)
+	vss := flag.String("vss", "virtual", "memory reported as vss: "+memoryNames)
+	flag.Parse()
+
+	cpuModes := map[string]pse.CPUMode{
+		"percore": pse.CPUPerCore,
+		"machine": pse.CPUMachine,
+		"seconds": pse.CPUSecondsTotal,
 	}
-	return nil
-}
-
-func pdhOpenQuery(datasrc *uint16, userdata uint32, query *PDH_HQUERY) error {
-	r0, _, _ := syscall.Syscall(winPdhOpenQuery.Addr(), 3, 0 /*uintptr(unsafe.Pointer(datasrc))*/, uintptr(userdata), uintptr(unsafe.Pointer(query)))
-	if r0 != 0 {
-		return fmt.Errorf("pdhOpenQuery failed. %d", r0)
+	cpuMode, ok := cpuModes[*cpu]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown cpu mode %q\n", *cpu)
+		os.Exit(2)
 	}
-	return nil
-}
 
-/*
-func pdhCloseQuery(hQuery PDH_HQUERY) error {
-	r0, _, _ := winPdhCloseQuery.Call(uintptr(hQuery))
-	if r0 != 0 {
-		return fmt.Errorf("pdhCloseQuery failed. %d", r0)
+	rssMetric, ok := memoryMetrics[*rss]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown rss memory %q\n", *rss)
+		os.Exit(2)
 	}
-	return nil
-}
-*/
-
-func pdhCollectQueryData(hQuery PDH_HQUERY) error {
-	r0, _, _ := winPdhCollectQueryData.Call(uintptr(hQuery))
-	if r0 != 0 {
-		return fmt.Errorf("pdhCollectQueryData failed. %d", r0)
+	vssMetric, ok := memoryMetrics[*vss]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown vss memory %q\n", *vss)
+		os.Exit(2)
 	}
-	return nil
-}
-
-func pdhGetFormattedCounterArrayDouble(hCounter PDH_HCOUNTER, lpdwBufferSize *uint32, lpdwBufferCount *uint32, itemBuffer *PDH_FMT_COUNTERVALUE_ITEM_DOUBLE) uint32 {
-	ret, _, _ := winPdhGetFormattedCounterArray.Call(
-		uintptr(hCounter),
-		uintptr(PDH_FMT_DOUBLE),
-		uintptr(unsafe.Pointer(lpdwBufferSize)),
-		uintptr(unsafe.Pointer(lpdwBufferCount)),
-		uintptr(unsafe.Pointer(itemBuffer)))
-
-	return uint32(ret)
-}
-
-// caller must ensure this is threadsafe
-func getCounterArrayData(counter PDH_HCOUNTER) ([]float64, error) {
-	var bufSize uint32
-	var bufCount uint32
 
-	// The API expects an addressable null pointer.
-	initialBuf := make([]PDH_FMT_COUNTERVALUE_ITEM_DOUBLE, 1)
-	ret := pdhGetFormattedCounterArrayDouble(counter, &bufSize, &bufCount, &initialBuf[0])
-
-	// This function always needs to be called twice...
-	if ret == PDH_MORE_DATA {
-		ret = pdhGetFormattedCounterArrayDouble(counter, &bufSize, &bufCount, &counterResults[0])
-		if ret == 0 {
-			rv := make([]float64, bufCount)
-			for i := 0; i < int(bufCount); i++ {
-				rv[i] = counterResults[i].FmtValue.DoubleValue
-			}
+	minInterval := time.Duration(0)
+	if *replay != "" {
+		*backend = "replay"
+		*interval = 0
+		minInterval = -1
+	}
 
-			return rv, nil
-		}
+	locales := map[string]*pse.TypeperfLocale{
+		"de": pse.TypeperfLocaleDE,
+		"fr": pse.TypeperfLocaleFR,
 	}
-	// if failure, or too many results, punt
-	if ret != 0 {
-		return nil, fmt.Errorf("getCounterArrayData: %d", ret)
+	typeperfLocale, ok := locales[*locale]
+	if *locale != "" && !ok {
+		fmt.Fprintf(os.Stderr, "unknown locale %q\n", *locale)
+		os.Exit(2)
 	}
 
-	return nil, nil
-}
-
-// initialize our counters
-func initCounters()  (err error) {
-		// require an addressible nil pointer
-		var source uint16
-		if err := pdhOpenQuery(&source, 0, &pcHandle); err != nil {
-			return err
+	var typeperfCounters []pse.TypeperfCounter
+	if *counters != "" {
+		for _, c := range strings.Split(*counters, ",") {
+			metric, counter, ok := strings.Cut(c, "=")
+			if !ok {
+				fmt.Fprintf(os.Stderr, "invalid counter %q, want metric=counter\n", c)
+				os.Exit(2)
+			}
+			typeperfCounters = append(typeperfCounters, pse.TypeperfCounter{Metric: metric, Counter: counter})
 		}
+	}
 
-		// setup the performance counters, search for all server instances
-		name := fmt.Sprintf("%s*", "gnatsd")
-		pidQuery := fmt.Sprintf("\\Process(%s)\\ID Process", name)
-		cpuQuery := fmt.Sprintf("\\Process(%s)\\%% Processor Time", name)
-		rssQuery := fmt.Sprintf("\\Process(%s)\\Working Set - Private", name)
-		vssQuery := fmt.Sprintf("\\Process(%s)\\Virtual Bytes", name)
+	s, err := pse.NewSampler(&pse.Options{
+		Backend:     *backend,
+		CPUMode:     cpuMode,
+		RSSMetric:   rssMetric,
+		VSSMetric:   vssMetric,
+		MinInterval: minInterval,
+		ImageName:   *image,
+		Wildcard:    *wildcard,
+
+		StreamInterval:   *stream,
+		TypeperfLocale:   typeperfLocale,
+		TypeperfCounters: typeperfCounters,
+		ReplayFile:       *replay,
+	})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	defer s.Close()
 
-		if err = pdhAddCounter(pcHandle, pidQuery, 0, &pidCounter); err != nil {
-			return err
-		}
-		if err = pdhAddCounter(pcHandle, cpuQuery, 0, &cpuCounter); err != nil {
-			return err
-		}
-		if err = pdhAddCounter(pcHandle, rssQuery, 0, &rssCounter); err != nil {
-			return err
+	if *verbose {
+		diags := s.Diagnostics()
+		keys := make([]string, 0, len(diags))
+		for k := range diags {
+			keys = append(keys, k)
 		}
-		if err = pdhAddCounter(pcHandle, vssQuery, 0, &vssCounter); err != nil {
-			return err
+		sort.Strings(keys)
+		for _, k := range keys {
+			fmt.Printf("%s: %s\n", k, diags[k])
 		}
-		
-		// prime the counters by collecting once, and sleep to get somewhat 
-		// useful information the first call.  Counters for the CPUs require 
-		// collect calls.
-		if err = pdhCollectQueryData(pcHandle); err != nil {
-		    return err
-	    }	
-		
-		time.Sleep(50)
-		
-		return nil	
-}
-
-func ProcUsagePDH(pcpu *float64, rss, vss *int64) error {
-	var err error
-
-	// First time through, initialize counters.
-	if initialSample {
-		if err = initCounters(); err != nil {
-			return err
-		}
-        initialSample = false
-	} else if time.Since(lastSampleTime) < (2 * time.Second) {
-		// only refresh every two seconds as to minimize impact 
-		// on the server.
-		*pcpu = prevCPU
-		*rss = prevRss
-		*vss = prevVss
-		return nil
 	}
 
-	// always save the sample time, even on errors.
-	defer func() {
-		lastSampleTime = time.Now()
-		fmt.Printf("Taking sample time.")
-	}()
-
-    // refresh the performance counter data
-	if err = pdhCollectQueryData(pcHandle); err != nil {
-		return err
+	for i := 0; i < *count; i++ {
+		if *system {
+			su, err := s.UsageForSystem()
+			if err != nil {
+				fmt.Printf("UsageForSystem() error: %v\n", err)
+				return
+			}
+			printSystemUsage(su)
+		}
+		if *all {
+			usages, err := s.SnapshotAll()
+			if err == io.EOF {
+				return
+			}
+			if err != nil {
+				fmt.Printf("SnapshotAll() error: %v\n", err)
+				return
+			}
+			for _, u := range usages {
+				printUsage(u)
+			}
+		} else {
+			u, err := s.UsageForPID(*pid)
+			if err == io.EOF {
+				return
+			}
+			if err != nil {
+				fmt.Printf("UsageForPID() error: %v\n", err)
+				return
+			}
+			printUsage(u)
+		}
+		time.Sleep(*interval)
 	}
+}
 
-	// retrieve the fields
-	var pidAry, cpuAry, rssAry, vssAry []float64
-	if pidAry, err = getCounterArrayData(pidCounter); err != nil {
-		return err
-	}
-	if cpuAry, err = getCounterArrayData(cpuCounter); err != nil {
-		return err
-	}
-	if rssAry, err = getCounterArrayData(rssCounter); err != nil {
-		return err
-	}
-	if vssAry, err = getCounterArrayData(vssCounter); err != nil {
-		return err
-	}
+// memoryMetrics are the memory metrics selectable as rss and vss.
+var memoryMetrics = map[string]pse.Metrics{
+	"workingset":        pse.MetricWorkingSet,
+	"privateworkingset": pse.MetricPrivateWorkingSet,
+	"privatebytes":      pse.MetricPrivateBytes,
+	"virtual":           pse.MetricVirtual,
+	"peakworkingset":    pse.MetricPeakWorkingSet,
+	"peakprivatebytes":  pse.MetricPeakPrivateBytes,
+	"peakvirtual":       pse.MetricPeakVirtual,
+}
 
-	// TODO:  Move this, cleanup loop
-	pid := syscall.Getpid()
-	// TODO:  Remove this...
-	pid = 2480
-	idx := int(-1)
-	for i := range pidAry {
-		if int(pidAry[i]) == pid {
-			idx = i
-			break
-		}
+const memoryNames = "workingset, privateworkingset, privatebytes, virtual, peakworkingset, peakprivatebytes or peakvirtual"
+
+func printUsage(u pse.Usage) {
+	fmt.Printf("ProcUsage info: ")
+	fmt.Printf(" pid=%d,", u.PID)
+	fmt.Printf(" rss=%d,", u.RSS)
+	fmt.Printf(" vss=%d,", u.VSS)
+	fmt.Printf(" pcpu=%f,", u.CPU)
+	fmt.Printf(" user=%f,", u.UserCPU)
+	fmt.Printf(" kernel=%f,", u.KernelCPU)
+	fmt.Printf(" pmem=%f", u.MemPercent)
+	metrics := make([]string, 0, len(u.Counters))
+	for m := range u.Counters {
+		metrics = append(metrics, m)
 	}
-
-	// no pid found...
-	if idx < 0 {
-		return fmt.Errorf("Could not find pid in performance counter results.")
+	sort.Strings(metrics)
+	for _, m := range metrics {
+		fmt.Printf(", %s=%f", m, u.Counters[m])
 	}
-
-	// assign values from the performance counters
-	*pcpu = cpuAry[idx]
-	*rss = int64(rssAry[idx])
-	*vss = int64(vssAry[idx])
-
-	// save off cache values
-	prevCPU = *pcpu
-	prevRss = *rss
-	prevVss = *vss
-
-	return nil
+	fmt.Println()
 }
 
-func main() {
-
-	var pcpu float64
-	var rss, vss int64
-
-	for i := 0; i < 100000; i++ {
-		err := ProcUsagePDH(&pcpu, &rss, &vss)
-		if err != nil {
-			fmt.Printf("ProcUsage_PDH() error: %v", err)
-			return
-		}
-
-		fmt.Printf("ProcUsage info: ")
-		fmt.Printf(" rss=%d,", rss)
-		fmt.Printf(" vss=%d,", vss)
-		fmt.Printf(" pcpu=%f\n", pcpu)
-		time.Sleep(250 * time.Millisecond)
-	}
+func printSystemUsage(su pse.SystemUsage) {
+	fmt.Printf("SystemUsage info: ")
+	fmt.Printf(" cpu=%f,", su.CPU)
+	fmt.Printf(" mem=%d,", su.MemTotal)
+	fmt.Printf(" avail=%d,", su.MemAvailable)
+	fmt.Printf(" commit=%d,", su.CommitCharge)
+	fmt.Printf(" limit=%d\n", su.CommitLimit)
 }